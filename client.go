@@ -1,296 +1,1373 @@
 package psycho
 
 import (
-	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"strings"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
-)
+	"time"
 
-type Client interface {
-	HandleInfo(info map[string]interface{})
-	HandleMsg(subject string, payload []byte)
-}
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/subject"
+)
 
 type ErrConnClosed struct{}
 
 func (e ErrConnClosed) Error() string { return "psycho: using a closed connection" }
 
-type client struct {
-	dec  *clientDecoder
-	enc  *clientEncoder
-	send chan *ClientOperation
+// ErrStaleConnection is the fatal error of a client whose server stopped
+// answering pings.
+type ErrStaleConnection struct{}
+
+func (e ErrStaleConnection) Error() string { return "psycho: stale connection" }
+
+// ErrDisconnected is returned for publishes made while a client made with
+// Connect is reconnecting, once they no longer fit in the reconnect buffer.
+type ErrDisconnected struct{}
+
+func (e ErrDisconnected) Error() string { return "psycho: disconnected from the server" }
+
+type ErrTimeout struct{}
+
+func (e ErrTimeout) Error() string { return "psycho: timeout" }
+
+type ErrInvalidSubject struct {
+	subject string
+}
+
+func (e ErrInvalidSubject) Error() string {
+	return fmt.Sprintf("psycho: invalid subject %q", e.subject)
+}
+
+// Client speaks the protocol to a server over a single connection, or, if
+// made with Connect, over a new one whenever the last one fails. Dial
+// subscribes Conns to subjects, which share the connection.
+type Client struct {
+	send chan *outgoing
+
+	maxPayload int64
+	conns      map[connKey]*subscription
+	sids       map[uint64]*subscription
+	subs       *subject.Trie
+	lastSID    uint64
+
+	connect      ConnectOptions
+	encoding     string
+	errHandler   func(error)
+	pingInterval time.Duration
+	maxPingsOut  int32
+	pingsOut     int32
+
+	dialer            func() (io.ReadWriteCloser, error)
+	reconnectWait     time.Duration
+	maxReconnectWait  time.Duration
+	maxReconnects     int
+	reconnectBufSize  int
+	connectHandler    func()
+	disconnectHandler func(error)
+	reconnectHandler  func()
 
-	info  map[string]string
-	conns map[string]map[*Conn]struct{}
+	// session is the latest connection to the server, which fatal closes.
+	// It's guarded by the embedded lock.
+	session *session
+	// sending is the connection ops are passed on to, or nil while the
+	// client is reconnecting. It's guarded by sendMu.
+	sending *session
+	// pending holds the publishes made while reconnecting, to be sent once
+	// the client is back, and pendingSize the bytes of their payloads.
+	pending     []*protocol.ClientOperation
+	pendingSize int
+	pendingMu   sync.Mutex
+	// control holds the PONGs and UNSUBs to send. The reader goroutine sends
+	// those, and can't wait for the writer, which may be blocked on a server
+	// that's blocked on the reader. controlReady is signalled when one is
+	// added.
+	control      []*protocol.ClientOperation
+	controlReady chan struct{}
+	controlMu    sync.Mutex
 
+	info         map[string]string
 	infoReceived chan struct{}
+	infoOnce     sync.Once
 	closing      chan struct{}
 	fatalErr     error
+	fatalOnce    sync.Once
+	// sendMu is held for reading while an op is passed to send, so that the
+	// writer can switch connections once no one is passing ops anymore.
+	sendMu sync.RWMutex
+	// done tracks the goroutines Close waits for: the writer, the pinger and,
+	// if they can be unblocked by closing the reader, the readers.
+	done sync.WaitGroup
 	sync.RWMutex
 }
 
-func Newclient(reader io.Reader, writer io.Writer) *client {
-	c := &client{
-		dec:  NewClientDecoder(reader),
-		enc:  NewClientEncoder(writer),
-		send: make(chan *ClientOperation),
+// ClientOption configures a Client in NewClient.
+type ClientOption func(*Client)
+
+// Name sets the client name sent to the server in CONNECT.
+func Name(name string) ClientOption {
+	return func(c *Client) { c.connect.Name = name }
+}
+
+// ErrorHandler sets a function to be called with the errors the server sends
+// that don't end the connection, like ErrSlowConsumer. It's called from the
+// client's reader goroutine, so it shouldn't block.
+func ErrorHandler(fn func(error)) ClientOption {
+	return func(c *Client) { c.errHandler = fn }
+}
+
+// Verbose asks the server to acknowledge every op with +OK. It's off by
+// default to save the round trips, errors are reported either way.
+func Verbose(verbose bool) ClientOption {
+	return func(c *Client) { c.connect.Verbose = verbose }
+}
+
+// NoEcho asks the server not to deliver the client's own messages to its
+// subscriptions.
+func NoEcho() ClientOption {
+	return func(c *Client) { c.connect.NoEcho = true }
+}
+
+// Encoding asks the server to switch to encoding, protocol.EncodingBinary
+// for instance, after CONNECT. Servers that don't list it in INFO are spoken
+// to in text.
+func Encoding(encoding string) ClientOption {
+	return func(c *Client) { c.encoding = encoding }
+}
+
+// Token authenticates the client with a token.
+func Token(token string) ClientOption {
+	return func(c *Client) { c.connect.AuthToken = token }
+}
+
+// UserInfo authenticates the client with a user name and password.
+func UserInfo(user, pass string) ClientOption {
+	return func(c *Client) {
+		c.connect.User = user
+		c.connect.Pass = pass
+	}
+}
+
+// PingInterval sets how often the client pings the server to check that the
+// connection is still alive. Zero disables pings. The default is 2 minutes.
+func PingInterval(d time.Duration) ClientOption {
+	return func(c *Client) { c.pingInterval = d }
+}
+
+// MaxPingsOut sets how many pings can go unanswered before the client gives up
+// on the connection with ErrStaleConnection. The default is 2.
+func MaxPingsOut(n int) ClientOption {
+	return func(c *Client) { c.maxPingsOut = int32(n) }
+}
+
+// ReconnectWait sets how long a client made with Connect waits before trying
+// to reconnect. The wait doubles after every failed attempt, up to max. The
+// defaults are 100ms and 10s.
+func ReconnectWait(wait, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.reconnectWait = wait
+		c.maxReconnectWait = max
+	}
+}
+
+// MaxReconnects sets how many attempts in a row a client made with Connect
+// makes to reconnect before it fails with the error of the last one. A
+// negative n has it try forever. The default is 60.
+func MaxReconnects(n int) ClientOption {
+	return func(c *Client) { c.maxReconnects = n }
+}
+
+// ReconnectBufSize sets how many bytes of payloads, headers included, a
+// client made with Connect holds on to while reconnecting, to publish once
+// it's back. Publishes that don't fit return ErrDisconnected. The default is
+// 0, so that every publish made while reconnecting fails.
+func ReconnectBufSize(n int) ClientOption {
+	return func(c *Client) { c.reconnectBufSize = n }
+}
+
+// ConnectHandler sets a function to be called once the client has connected
+// to the server for the first time.
+func ConnectHandler(fn func()) ClientOption {
+	return func(c *Client) { c.connectHandler = fn }
+}
+
+// DisconnectHandler sets a function to be called with the error a connection
+// to the server failed with, before reconnecting, if the client was made with
+// Connect, or failing.
+func DisconnectHandler(fn func(error)) ClientOption {
+	return func(c *Client) { c.disconnectHandler = fn }
+}
+
+// ReconnectHandler sets a function to be called once a client made with
+// Connect has reconnected and subscribed its Conns anew.
+func ReconnectHandler(fn func()) ClientOption {
+	return func(c *Client) { c.reconnectHandler = fn }
+}
+
+// NewClient starts a client speaking the protocol over reader and writer. If
+// they implement io.Closer, they're closed when the client fails or is
+// closed.
+func NewClient(reader io.Reader, writer io.Writer, opts ...ClientOption) *Client {
+	c := newClient(opts)
+	c.start(newSession(reader, writer))
+	return c
+}
+
+// Connect starts a client on a connection made with dial. Whenever the
+// connection fails, the client dials a new one, as set with ReconnectWait and
+// MaxReconnects, and subscribes every open Conn on it anew, so that Conns
+// keep receiving once it's back. Connect returns the error of the first dial.
+func Connect(dial func() (io.ReadWriteCloser, error), opts ...ClientOption) (*Client, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(opts)
+	c.dialer = dial
+	c.start(newSession(conn, conn))
+	return c, nil
+}
+
+// NewServerClient starts a client on top of server, served by a ServerCodec
+// over an in-memory pipe, for programs that talk to a Server directly rather
+// than through a process like stdio. It calls server.ServeServerOpsTo, which
+// most servers allow only once.
+func NewServerClient(server Server, opts ...ClientOption) *Client {
+	serverEnd, clientEnd := net.Pipe()
+	codec := NewServerCodec(serverEnd, serverEnd)
+	go server.ServeServerOpsTo(codec)
+	go codec.ServeClientOpsTo(server)
+	return NewClient(clientEnd, clientEnd, opts...)
+}
+
+func newClient(opts []ClientOption) *Client {
+	c := &Client{
+		send:         make(chan *outgoing),
+		controlReady: make(chan struct{}, 1),
+
+		conns: map[connKey]*subscription{},
+		sids:  map[uint64]*subscription{},
+		subs:  subject.NewTrie(),
+
+		connect: ConnectOptions{
+			Protocol: ProtocolVersion,
+		},
+		pingInterval: 2 * time.Minute,
+		maxPingsOut:  2,
 
-		conns: map[string]map[*Conn]struct{}{},
+		reconnectWait:    100 * time.Millisecond,
+		maxReconnectWait: 10 * time.Second,
+		maxReconnects:    60,
 
 		infoReceived: make(chan struct{}),
 		closing:      make(chan struct{}),
 	}
-	go c.reader()
-	go c.writer()
+	for _, opt := range opts {
+		opt(c)
+	}
 	return c
 }
 
-func (c *client) Dial(subject string) (*Conn, error) {
+// start starts the client's goroutines on its first connection, s.
+func (c *Client) start(s *session) {
+	c.session = s
+	c.sending = s
+	c.startReader(s)
+	c.done.Add(1)
+	go c.writer(s)
+	if c.pingInterval > 0 {
+		c.done.Add(1)
+		go c.pinger()
+	}
+}
+
+// startReader starts a reader goroutine for s, which Close waits for if
+// closing s unblocks it.
+func (c *Client) startReader(s *session) {
+	if !s.closable {
+		go c.reader(s)
+		return
+	}
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+		c.reader(s)
+	}()
+}
+
+// session is a single connection to the server.
+type session struct {
+	dec      *protocol.ClientDecoder
+	enc      *protocol.ClientEncoder
+	closers  []io.Closer
+	closable bool
+
+	// info is closed once the server's INFO arrives, which is then in
+	// infoMap.
+	info    chan struct{}
+	infoMap map[string]string
+
+	// pongs are waiting for the PONGs of the PINGs written so far, in order.
+	// Keep-alive PINGs have nil waiters.
+	pongs  []*pongWaiter
+	pongMu sync.Mutex
+	// unpinged counts the ops written since the last PING. It's only used
+	// by the writer goroutine.
+	unpinged int
+
+	// done is closed once the connection fails, with err.
+	done     chan struct{}
+	err      error
+	failOnce sync.Once
+}
+
+// outgoing is an op passed to the writer goroutine. If pong is set, the
+// writer follows op, if any, with a PING whose PONG pong waits for.
+type outgoing struct {
+	op   *protocol.ClientOperation
+	pong *pongWaiter
+}
+
+// pongWaiter waits for the PONG of a PING, and gets the error the connection
+// failed with if it fails first.
+type pongWaiter struct {
+	done chan error
+	// sync marks a PING written right after a publish, and right after the
+	// PONG of every op before it, so that the errors the server sends
+	// before the PONG are about the publish. The first of them ends up in
+	// err.
+	sync bool
+	err  error
+}
+
+func newPongWaiter(sync bool) *pongWaiter {
+	return &pongWaiter{done: make(chan error, 1), sync: sync}
+}
+
+// send writes the op of out and the PING that goes with it.
+func (s *session) send(out *outgoing) error {
+	if out.pong != nil && out.pong.sync && s.unpinged > 0 {
+		if err := s.ping(nil); err != nil {
+			return err
+		}
+	}
+	if out.op != nil {
+		if out.op.Type == protocol.TypePing {
+			return s.ping(out.pong)
+		}
+		if err := write(s.enc, out.op); err != nil {
+			return err
+		}
+		s.unpinged++
+	}
+	if out.pong != nil {
+		return s.ping(out.pong)
+	}
+	return nil
+}
+
+// ping writes a PING whose PONG w waits for. The PONG may arrive before
+// Ping returns, so w is queued first.
+func (s *session) ping(w *pongWaiter) error {
+	s.pongMu.Lock()
 	select {
-	case c.send <- &ClientOperation{
-		Type:    TypeSubscribe,
-		Subject: subject,
-	}:
-	case <-c.closing:
-		return nil, ErrConnClosed{}
+	case <-s.done:
+		if w != nil {
+			w.done <- s.err
+		}
+	default:
+		s.pongs = append(s.pongs, w)
+	}
+	s.pongMu.Unlock()
+	s.unpinged = 0
+	return s.enc.Ping()
+}
+
+// pong pops the waiter of the PING a PONG answers, and passes it the first
+// error received for its publish.
+func (s *session) pong() {
+	s.pongMu.Lock()
+	defer s.pongMu.Unlock()
+	if len(s.pongs) == 0 {
+		return
+	}
+	w := s.pongs[0]
+	s.pongs = s.pongs[1:]
+	if w != nil {
+		w.done <- w.err
+	}
+}
+
+// syncErr hands err to the waiter of the next PONG, if that waits for a
+// publish, and reports whether it did.
+func (s *session) syncErr(err error) bool {
+	s.pongMu.Lock()
+	defer s.pongMu.Unlock()
+	if len(s.pongs) == 0 || s.pongs[0] == nil || !s.pongs[0].sync {
+		return false
+	}
+	if s.pongs[0].err == nil {
+		s.pongs[0].err = err
+	}
+	return true
+}
+
+func newSession(reader io.Reader, writer io.Writer) *session {
+	s := &session{
+		dec:  protocol.NewClientDecoder(reader),
+		enc:  protocol.NewClientEncoder(writer),
+		info: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, rw := range []interface{}{reader, writer} {
+		if closer, ok := rw.(io.Closer); ok {
+			s.closers = append(s.closers, closer)
+		}
+	}
+	_, s.closable = reader.(io.Closer)
+	return s
+}
+
+// fail ends the connection with err, closing the underlying reader and
+// writer to unblock the goroutines using them.
+func (s *session) fail(err error) {
+	s.failOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		for _, closer := range s.closers {
+			closer.Close()
+		}
+		s.pongMu.Lock()
+		for _, w := range s.pongs {
+			if w != nil {
+				w.done <- err
+			}
+		}
+		s.pongs = nil
+		s.pongMu.Unlock()
+	})
+}
+
+// subscription is a server-side subscription, shared by every Conn dialed on
+// the same subject and queue group. It's unsubscribed when the last of them
+// closes.
+type subscription struct {
+	sid     uint64
+	subject string
+	queue   string
+	conns   map[*Conn]struct{}
+}
+
+// receivers appends the Conns that should receive a message of sub to conns:
+// all of them, or one at random in a queue group.
+func (sub *subscription) receivers(conns []*Conn) []*Conn {
+	if sub.queue == "" {
+		for conn := range sub.conns {
+			conns = append(conns, conn)
+		}
+		return conns
+	}
+	i := mathrand.Intn(len(sub.conns))
+	for conn := range sub.conns {
+		if i == 0 {
+			return append(conns, conn)
+		}
+		i--
+	}
+	return conns
+}
+
+type connKey struct {
+	subject string
+	queue   string
+}
+
+// Dial subscribes to subject, which may contain "*" and ">" wildcards. The
+// returned Conn receives messages published on every matching subject, but
+// can only Send if subject is a literal.
+func (c *Client) Dial(subj string, opts ...ConnOption) (*Conn, error) {
+	return c.dial(context.Background(), subj, "", opts)
+}
+
+// DialContext is like Dial, but gives up with ctx's error once ctx is done
+// before the SUB is passed on to be sent.
+func (c *Client) DialContext(ctx context.Context, subj string, opts ...ConnOption) (*Conn, error) {
+	return c.dial(ctx, subj, "", opts)
+}
+
+// DialQueue is like Dial, but joins the queue group named group. Each message
+// is received by only one Conn in the group, whether it's in this or another
+// client.
+func (c *Client) DialQueue(subj, group string, opts ...ConnOption) (*Conn, error) {
+	if !subject.ValidSubject(group) {
+		return nil, ErrInvalidSubject{group}
+	}
+	return c.dial(context.Background(), subj, group, opts)
+}
+
+func (c *Client) dial(ctx context.Context, subj, queue string, opts []ConnOption) (*Conn, error) {
+	if !subject.ValidPattern(subj) {
+		return nil, ErrInvalidSubject{subj}
 	}
 	conn := &Conn{
-		subject: subject,
-		recv:    make(chan []byte),
-		send:    c.send,
+		subject: subj,
+		buffer:  DefaultRecvBuffer,
+		client:  c,
+		closing: make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(conn)
+	}
+	conn.recv = make(chan *Msg, conn.buffer)
+
 	c.Lock()
-	if _, ok := c.conns[subject]; !ok {
-		c.conns[subject] = map[*Conn]struct{}{}
+	sub, ok := c.conns[connKey{subj, queue}]
+	if !ok {
+		c.lastSID++
+		sub = &subscription{
+			sid:     c.lastSID,
+			subject: subj,
+			queue:   queue,
+			conns:   map[*Conn]struct{}{},
+		}
+		c.conns[connKey{subj, queue}] = sub
+		c.sids[sub.sid] = sub
+		c.subs.Insert(subj, sub)
 	}
-	c.conns[subject][conn] = struct{}{}
+	sub.conns[conn] = struct{}{}
+	conn.sid = sub.sid
 	c.Unlock()
+
+	if ok {
+		return conn, nil
+	}
+	err := c.enqueueContext(ctx, &protocol.ClientOperation{
+		Type:    protocol.TypeSubscribe,
+		Subject: subj,
+		SID:     sub.sid,
+		Queue:   queue,
+	})
+	if err != nil {
+		c.Lock()
+		c.remove(conn)
+		c.Unlock()
+		return nil, err
+	}
 	return conn, nil
 }
 
-func (c *client) Info() (map[string]string, error) {
+// Publish sends payload to subject without subscribing to it.
+func (c *Client) Publish(subj string, payload []byte) error {
+	return c.publish(context.Background(), subj, "", nil, payload)
+}
+
+// PublishMsg is like Publish, but also sends the reply subject and headers of
+// msg.
+func (c *Client) PublishMsg(msg *Msg) error {
+	return c.publish(context.Background(), msg.Subject, msg.Reply, msg.Header, msg.Payload)
+}
+
+func (c *Client) publish(ctx context.Context, subj, reply string, header Header, payload []byte) error {
+	if !subject.ValidSubject(subj) {
+		return ErrInvalidSubject{subj}
+	}
+	if reply != "" && !subject.ValidSubject(reply) {
+		return ErrInvalidSubject{reply}
+	}
+	if err := header.Validate(); err != nil {
+		return err
+	}
+	if err := c.checkPayload(header, payload); err != nil {
+		return err
+	}
+	return c.enqueueContext(ctx, &protocol.ClientOperation{
+		Type:    protocol.TypePublish,
+		Subject: subj,
+		Reply:   reply,
+		Header:  header,
+		Payload: payload,
+	})
+}
+
+// Request publishes payload to subject with a unique inbox subject to reply
+// to, and waits for the first response on it.
+func (c *Client) Request(subj string, payload []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := c.RequestContext(ctx, subj, payload)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeout{}
+	}
+	return resp, err
+}
+
+// RequestContext is like Request, but waits until ctx is done rather than
+// for a timeout, and returns ctx's error then. Either way the inbox is
+// unsubscribed before it returns.
+func (c *Client) RequestContext(ctx context.Context, subj string, payload []byte) ([]byte, error) {
+	inbox, err := c.dial(ctx, newInbox(), "", []ConnOption{RecvBuffer(1)})
+	if err != nil {
+		return nil, err
+	}
+	defer inbox.Close()
+
+	if err := c.publish(ctx, subj, inbox.subject, nil, payload); err != nil {
+		return nil, err
+	}
+	msg, err := inbox.ReceiveMsgContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Payload, nil
+}
+
+// Flush waits for the server to receive every op passed on to be sent before
+// the call, by sending a PING and waiting for its PONG. It fails with
+// ErrDisconnected while the client is reconnecting.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.roundTrip(ctx, &outgoing{pong: newPongWaiter(false)})
+}
+
+// roundTrip passes out, which waits for a PONG, to the writer goroutine and
+// waits for the PONG.
+func (c *Client) roundTrip(ctx context.Context, out *outgoing) error {
+	if err := c.pass(ctx, out); err != nil {
+		return err
+	}
+	select {
+	case err := <-out.pong.done:
+		return err
+	case <-c.closing:
+		return c.fatalErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkPayload returns ErrPayloadTooLarge if header and payload together are
+// larger than the max_payload advertised by the server. Until INFO arrives
+// there's nothing to check against.
+func (c *Client) checkPayload(header Header, payload []byte) error {
+	max := atomic.LoadInt64(&c.maxPayload)
+	if max == 0 {
+		return nil
+	}
+	if n := protocol.PayloadSize(header, payload); int64(n) > max {
+		return ErrPayloadTooLarge{Reason: fmt.Sprintf("%d bytes exceeds the maximum of %d", n, max)}
+	}
+	return nil
+}
+
+func newInbox() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return "_INBOX." + hex.EncodeToString(b[:])
+}
+
+// Info waits for the server's INFO and returns its values. Strings are
+// unquoted and other values are kept as JSON.
+func (c *Client) Info() (map[string]string, error) {
+	return c.InfoContext(context.Background())
+}
+
+// InfoContext is like Info, but gives up with ctx's error once ctx is done.
+func (c *Client) InfoContext(ctx context.Context) (map[string]string, error) {
 	select {
 	case <-c.infoReceived:
 	case <-c.closing:
 		return nil, c.fatalErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 	return c.info, nil
 }
 
-func (c *client) unsubscribe(conn *Conn) {
+func (c *Client) unsubscribe(conn *Conn) {
 	c.Lock()
-	delete(c.conns[conn.subject], conn)
+	sub, last := c.remove(conn)
 	c.Unlock()
-	close(conn.recv)
 	close(conn.closing)
+
+	if !last {
+		return
+	}
+	// A slow consumer's Conn is closed on the reader goroutine.
+	c.enqueueControl(&protocol.ClientOperation{
+		Type:    protocol.TypeUnsubscribe,
+		Subject: sub.subject,
+		SID:     sub.sid,
+		Queue:   sub.queue,
+	})
 }
 
-func (c *client) reader() {
-	var infoOnce sync.Once
+// remove unregisters conn from its subscription, and the subscription too if
+// conn was its last Conn. The caller must hold the lock.
+func (c *Client) remove(conn *Conn) (sub *subscription, last bool) {
+	sub = c.sids[conn.sid]
+	delete(sub.conns, conn)
+	if len(sub.conns) > 0 {
+		return sub, false
+	}
+	delete(c.conns, connKey{sub.subject, sub.queue})
+	delete(c.sids, sub.sid)
+	c.subs.Remove(sub.subject, sub)
+	return sub, true
+}
+
+// enqueue passes op to the writer goroutine. Once the client has failed, it
+// returns the error the client failed with instead. While the client is
+// reconnecting, op is held on to or dropped, see hold.
+func (c *Client) enqueue(op *protocol.ClientOperation) error {
+	return c.pass(context.Background(), &outgoing{op: op})
+}
+
+// enqueueContext is like enqueue, but gives up with ctx's error once ctx is
+// done. The op isn't sent then.
+func (c *Client) enqueueContext(ctx context.Context, op *protocol.ClientOperation) error {
+	return c.pass(ctx, &outgoing{op: op})
+}
+
+// enqueueControl queues op for the writer goroutine without waiting for it.
+// The writer sends it before any op passed to it later. Ops queued while the client is reconnecting go
+// out on the next connection, once it's subscribed.
+func (c *Client) enqueueControl(op *protocol.ClientOperation) {
+	c.controlMu.Lock()
+	c.control = append(c.control, op)
+	c.controlMu.Unlock()
+	select {
+	case c.controlReady <- struct{}{}:
+	default:
+	}
+}
+
+// sendControl sends the ops queued with enqueueControl on s.
+func (c *Client) sendControl(s *session) error {
+	c.controlMu.Lock()
+	ops := c.control
+	c.control = nil
+	c.controlMu.Unlock()
+	for _, op := range ops {
+		if err := s.send(&outgoing{op: op}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pass passes out to the writer goroutine like enqueueContext.
+func (c *Client) pass(ctx context.Context, out *outgoing) error {
+	for {
+		c.sendMu.RLock()
+		select {
+		case <-c.closing:
+			c.sendMu.RUnlock()
+			return c.fatalErr
+		default:
+		}
+		s := c.sending
+		if s == nil {
+			err := c.hold(out)
+			c.sendMu.RUnlock()
+			return err
+		}
+		select {
+		case c.send <- out:
+			c.sendMu.RUnlock()
+			return nil
+		case <-c.closing:
+			c.sendMu.RUnlock()
+			return c.fatalErr
+		case <-ctx.Done():
+			c.sendMu.RUnlock()
+			return ctx.Err()
+		case <-s.done:
+			// The writer is about to switch connections.
+			c.sendMu.RUnlock()
+		}
+	}
+}
+
+// hold keeps a publish made while the client is reconnecting, if it fits in
+// the reconnect buffer, to send once the client is back. Other ops are
+// dropped: the client subscribes anew on reconnecting anyway. Ops waiting
+// for a PONG fail with ErrDisconnected, since there's no server to answer.
+func (c *Client) hold(out *outgoing) error {
+	if out.pong != nil {
+		return ErrDisconnected{}
+	}
+	op := out.op
+	if op.Type != protocol.TypePublish {
+		return nil
+	}
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	n := protocol.PayloadSize(op.Header, op.Payload)
+	if c.pendingSize+n > c.reconnectBufSize {
+		return ErrDisconnected{}
+	}
+	c.pending = append(c.pending, op)
+	c.pendingSize += n
+	return nil
+}
+
+// deliver passes a message on to the Conns of the subscription with the given
+// sid or, if the server didn't send one, of every subscription matching the
+// subject.
+func (c *Client) deliver(op protocol.ServerOperation) {
 	var conns []*Conn
+	c.RLock()
+	if op.SID != 0 {
+		if sub, ok := c.sids[op.SID]; ok {
+			conns = sub.receivers(conns)
+		}
+	} else {
+		for _, sub := range c.subs.Match(op.Subject) {
+			conns = sub.(*subscription).receivers(conns)
+		}
+	}
+	c.RUnlock()
+	msg := &Msg{
+		Subject: op.Subject,
+		Reply:   op.Reply,
+		Header:  op.Header,
+		Payload: op.Payload,
+	}
+	for _, conn := range conns {
+		conn.received(msg)
+	}
+}
+
+func (c *Client) reader(s *session) {
+	var infoOnce sync.Once
 	for {
-		op, err := c.dec.ReadOperation()
+		op, err := s.dec.ReadOperation()
 		if err != nil {
-			c.fatal(err)
+			s.fail(err)
 			return
 		}
 		switch op.Type {
-		case TypeMessage:
-			conns = conns[:0]
-			c.RLock()
-			for conn := range c.conns[op.Subject] {
-				conns = append(conns, conn)
+		case protocol.TypeMessage:
+			c.deliver(op)
+		case protocol.TypeInfo:
+			if n, err := strconv.Atoi(op.Map["max_payload"]); err == nil && n > 0 {
+				atomic.StoreInt64(&c.maxPayload, int64(n))
+				s.dec.SetMaxPayload(n)
 			}
-			c.RUnlock()
-			for _, conn := range conns {
-				conn.received(op.Payload)
-			}
-		case TypeInfo:
 			infoOnce.Do(func() {
+				s.infoMap = op.Map
+				close(s.info)
+			})
+			c.infoOnce.Do(func() {
 				c.info = op.Map
 				close(c.infoReceived)
 			})
-		case TypeOK:
-		case TypeError:
-			c.fatal(errors.New(string(op.Payload)))
-			return
+		case protocol.TypeServerPing:
+			c.enqueueControl(&protocol.ClientOperation{Type: protocol.TypePong})
+		case protocol.TypeServerPong:
+			atomic.StoreInt32(&c.pingsOut, 0)
+			s.pong()
+		case protocol.TypeOK:
+		case protocol.TypeError:
+			if IsFatal(op.Err) {
+				s.fail(op.Err)
+				return
+			}
+			if !s.syncErr(op.Err) && c.errHandler != nil {
+				c.errHandler(op.Err)
+			}
 		}
 	}
 }
 
-func (c *client) writer() {
-	for op := range c.send {
-		switch op.Type {
-		case TypePublish:
-			c.enc.Publish(op.Subject, op.Payload)
-		case TypeSubscribe:
-			c.enc.Subscribe(op.Subject)
-		case TypeUnsubscribe:
-			c.enc.Unsubscribe(op.Subject)
+// writer serves each connection in turn, starting with s. When one fails,
+// a client made with Connect reconnects, and any other client fails.
+func (c *Client) writer(s *session) {
+	defer c.done.Done()
+	for first := true; ; first = false {
+		err := c.serve(s, first)
+		select {
+		case <-c.closing:
+			return
+		default:
+		}
+		c.sendMu.Lock()
+		c.sending = nil
+		c.sendMu.Unlock()
+		if c.disconnectHandler != nil {
+			c.disconnectHandler(err)
+		}
+		if c.dialer == nil {
+			c.fatal(err)
+			return
+		}
+		if s = c.reconnect(err); s == nil {
+			return
 		}
 	}
 }
 
-func (c *client) fatal(err error) {
-	c.fatalErr = err
-	close(c.closing)
+// serve sends CONNECT on s once the server's INFO arrives and then every op
+// passed to the send channel, until s fails or the client is closed. On a
+// connection other than the first, it subscribes every subscription anew and
+// sends the publishes held while reconnecting before any other op.
+func (c *Client) serve(s *session, first bool) error {
+	select {
+	case <-s.info:
+	case <-s.done:
+		return s.err
+	case <-c.closing:
+		return c.fatalErr
+	}
+	connect := c.connect
+	if c.encoding != "" && serverSupports(s.infoMap, c.encoding) {
+		connect.Encoding = c.encoding
+	}
+	if err := s.enc.Connect(connect); err != nil {
+		s.fail(err)
+		return err
+	}
+	s.enc.SetEncoding(connect.Encoding)
+	atomic.StoreInt32(&c.pingsOut, 0)
+
+	if first {
+		if c.connectHandler != nil {
+			c.connectHandler()
+		}
+	} else {
+		c.sendMu.Lock()
+		err := c.resume(s)
+		if err == nil {
+			c.sending = s
+		}
+		c.sendMu.Unlock()
+		if err != nil {
+			s.fail(err)
+			return err
+		}
+		if c.reconnectHandler != nil {
+			c.reconnectHandler()
+		}
+	}
+
+	for {
+		select {
+		case out := <-c.send:
+			// Ops queued before out go first.
+			err := c.sendControl(s)
+			if err == nil {
+				err = s.send(out)
+			}
+			if err != nil {
+				s.fail(err)
+				return err
+			}
+		case <-c.controlReady:
+			if err := c.sendControl(s); err != nil {
+				s.fail(err)
+				return err
+			}
+		case <-s.done:
+			return s.err
+		case <-c.closing:
+			return c.fatalErr
+		}
+	}
 }
 
-type Conn struct {
-	subject string
-	recv    chan []byte
-	send    chan *ClientOperation
+// resume subscribes every subscription on s and sends the publishes held
+// while reconnecting. The caller must hold sendMu, so that no other op gets
+// in between.
+func (c *Client) resume(s *session) error {
+	c.RLock()
+	subs := make([]*subscription, 0, len(c.sids))
+	for _, sub := range c.sids {
+		subs = append(subs, sub)
+	}
+	c.RUnlock()
+	sort.Slice(subs, func(i, j int) bool { return subs[i].sid < subs[j].sid })
+	for _, sub := range subs {
+		op := &protocol.ClientOperation{
+			Type:    protocol.TypeSubscribe,
+			Subject: sub.subject,
+			SID:     sub.sid,
+			Queue:   sub.queue,
+		}
+		if err := s.send(&outgoing{op: op}); err != nil {
+			return err
+		}
+	}
 
-	client *client
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending, c.pendingSize = nil, 0
+	c.pendingMu.Unlock()
+	for _, op := range pending {
+		if err := s.send(&outgoing{op: op}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconnect dials the server until it succeeds, waiting longer after every
+// failed attempt, and returns the new connection. After maxReconnects failed
+// attempts the client fails with the error of the last one, or err if there
+// were none. It returns nil if the client fails or is closed meanwhile.
+func (c *Client) reconnect(err error) *session {
+	wait := c.reconnectWait
+	for attempt := 0; c.maxReconnects < 0 || attempt < c.maxReconnects; attempt++ {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.closing:
+			timer.Stop()
+			return nil
+		}
+		if wait *= 2; wait > c.maxReconnectWait {
+			wait = c.maxReconnectWait
+		}
 
-	recvMsgs, recvBytes uint64
-	closing             chan struct{}
+		conn, dialErr := c.dialer()
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+		s := newSession(conn, conn)
+		c.Lock()
+		select {
+		case <-c.closing:
+			c.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		c.session = s
+		c.Unlock()
+		c.startReader(s)
+		return s
+	}
+	c.fatal(err)
+	return nil
 }
 
-func (c *Conn) Send(payload []byte) error {
-	select {
-	case c.send <- &ClientOperation{
-		Type:    TypePublish,
-		Subject: c.subject,
-		Payload: payload,
-	}:
-		return nil
-	case <-c.closing:
-		return ErrConnClosed{}
+func write(enc *protocol.ClientEncoder, op *protocol.ClientOperation) error {
+	switch op.Type {
+	case protocol.TypePublish:
+		return enc.Publish(op.Subject, op.Reply, op.Header, op.Payload)
+	case protocol.TypeSubscribe:
+		return enc.Subscribe(op.Subject, op.SID, op.Queue)
+	case protocol.TypeUnsubscribe:
+		return enc.Unsubscribe(op.Subject, op.SID, op.Queue)
+	case protocol.TypePing:
+		return enc.Ping()
+	case protocol.TypePong:
+		return enc.Pong()
 	}
+	return nil
 }
 
-func (c *Conn) Receive() ([]byte, error) {
-	payload, ok := <-c.recv
-	if !ok {
-		return nil, ErrConnClosed{}
+// serverSupports reports whether the server lists encoding in its INFO.
+func serverSupports(info map[string]string, encoding string) bool {
+	var encodings []string
+	json.Unmarshal([]byte(info["encodings"]), &encodings)
+	for _, e := range encodings {
+		if e == encoding {
+			return true
+		}
 	}
-	return payload, nil
+	return false
 }
 
-func (c *Conn) Close() {
-	c.client.unsubscribe(c)
+// pinger pings the server every pingInterval and fails the connection once
+// maxPingsOut pings in a row have gone unanswered.
+func (c *Client) pinger() {
+	defer c.done.Done()
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closing:
+			return
+		}
+		c.sendMu.RLock()
+		s := c.sending
+		c.sendMu.RUnlock()
+		if s == nil {
+			continue
+		}
+		if atomic.LoadInt32(&c.pingsOut) >= c.maxPingsOut {
+			s.fail(ErrStaleConnection{})
+			continue
+		}
+		atomic.AddInt32(&c.pingsOut, 1)
+		c.enqueue(&protocol.ClientOperation{Type: protocol.TypePing})
+	}
 }
 
-func (c *Conn) received(payload []byte) {
-	atomic.AddUint64(&c.recvMsgs, 1)
-	atomic.AddUint64(&c.recvBytes, uint64(len(payload)))
+// Err returns the error the client failed with, ErrConnClosed if it was
+// closed, or nil while it's running.
+func (c *Client) Err() error {
 	select {
-	case c.recv <- payload:
+	case <-c.closing:
+		return c.fatalErr
 	default:
+		return nil
 	}
 }
 
-type ServerOpType int
+// Close closes the connection to the server and waits for the client's
+// goroutines to stop, except for the reader goroutine if the reader passed to
+// NewClient isn't an io.Closer, and for a dial in progress to return. Every
+// pending and later call on the client and its Conns returns ErrConnClosed.
+// Close mustn't be called from an ErrorHandler or the connection handlers,
+// which run on the client's goroutines.
+func (c *Client) Close() error {
+	c.fatal(ErrConnClosed{})
+	c.done.Wait()
+	return nil
+}
 
-const (
-	TypeInfo ServerOpType = iota + 1
-	TypeMessage
-	TypeOK
-	TypeError
-)
+// fatal fails the client with err, which every pending and later call
+// returns, and closes its connection to unblock its goroutines.
+func (c *Client) fatal(err error) {
+	c.fatalOnce.Do(func() {
+		c.fatalErr = err
+		close(c.closing)
+		c.RLock()
+		s := c.session
+		c.RUnlock()
+		s.fail(err)
+	})
+}
 
-type ServerOperation struct {
-	Type    ServerOpType
+// Msg is a message received on a Conn.
+type Msg struct {
 	Subject string
+	// Reply is the subject the publisher expects a response on, if any.
+	Reply   string
+	Header  Header
 	Payload []byte
-	Map     map[string]string
 }
 
-type clientDecoder struct {
-	reader *bufio.Reader
+// DefaultRecvBuffer is how many received messages a Conn holds on to until
+// they're read, unless set otherwise with RecvBuffer.
+const DefaultRecvBuffer = 64
+
+// SlowConsumerPolicy decides what a Conn does with a message that arrives
+// while its buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest drops the message that arrived. It's the default.
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest drops the oldest message in the buffer to make room.
+	DropOldest
+	// BlockReader waits for room in the buffer. Meanwhile the client reads
+	// nothing from the server, which holds up every other Conn of the
+	// client, and the server may drop messages or the connection in turn.
+	BlockReader
+	// Disconnect closes the Conn, whose Receive returns ErrSlowConsumer
+	// from then on.
+	Disconnect
+)
+
+// ConnOption configures a Conn in Dial.
+type ConnOption func(*Conn)
+
+// RecvBuffer sets how many received messages the Conn holds on to until
+// they're read. With 0, messages are only received while a Receive is
+// waiting for them.
+func RecvBuffer(n int) ConnOption {
+	return func(c *Conn) { c.buffer = n }
+}
+
+// SlowConsumer sets what the Conn does with messages that arrive while its
+// buffer is full.
+func SlowConsumer(policy SlowConsumerPolicy) ConnOption {
+	return func(c *Conn) { c.policy = policy }
 }
 
-func NewClientDecoder(r io.Reader) *clientDecoder {
-	return &clientDecoder{
-		reader: bufio.NewReader(r),
+type Conn struct {
+	subject string
+	sid     uint64
+	recv    chan *Msg
+	buffer  int
+	policy  SlowConsumerPolicy
+	workers int
+
+	client *Client
+
+	recvMsgs, recvBytes, droppedMsgs uint64
+	closing                          chan struct{}
+	closeOnce                        sync.Once
+	// closeErr is what Receive returns once the Conn is closed.
+	closeErr error
+}
+
+// ConnStats are the counters of a Conn.
+type ConnStats struct {
+	// Msgs and Bytes count the messages that arrived and their payload
+	// bytes, whether they were read or dropped.
+	Msgs, Bytes uint64
+	// Dropped counts the messages that were dropped because the Conn's
+	// buffer was full.
+	Dropped uint64
+}
+
+// Stats returns the Conn's counters.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		Msgs:    atomic.LoadUint64(&c.recvMsgs),
+		Bytes:   atomic.LoadUint64(&c.recvBytes),
+		Dropped: atomic.LoadUint64(&c.droppedMsgs),
 	}
 }
 
-func (d *clientDecoder) ReadOperation() (ServerOperation, error) {
-	line, err := d.reader.ReadString('\n')
+func (c *Conn) Send(payload []byte) error {
+	return c.SendContext(context.Background(), payload)
+}
+
+// SendContext is like Send, but gives up with ctx's error once ctx is done
+// before the message is passed on to be sent.
+func (c *Conn) SendContext(ctx context.Context, payload []byte) error {
+	op, err := c.publishOp(payload)
 	if err != nil {
-		return ServerOperation{}, err
+		return err
 	}
-	tokens := strings.Split(line[:len(line)-1], " ")
+	return c.client.enqueueContext(ctx, op)
+}
 
-	if len(tokens) < 1 {
-		return ServerOperation{}, errors.New("len(tokens) < 1")
+// SendSync is like SendContext, but also waits for the server to receive the
+// message. It returns the error the server answered the message with, such
+// as ErrPermissionDenied, which a plain Send leaves to the ErrorHandler.
+func (c *Conn) SendSync(ctx context.Context, payload []byte) error {
+	op, err := c.publishOp(payload)
+	if err != nil {
+		return err
 	}
+	return c.client.roundTrip(ctx, &outgoing{op: op, pong: newPongWaiter(true)})
+}
 
-	switch tokens[0] {
-	case "INFO":
-		if len(tokens) != 2 {
-			return ServerOperation{}, errors.New("INFO len(tokens) != 2")
-		}
-		m := map[string]json.Number{}
-		if err := json.Unmarshal([]byte(tokens[1]), &m); err != nil {
-			return ServerOperation{}, err
-		}
-		op := ServerOperation{
-			Type:    TypeInfo,
-			Payload: []byte(tokens[1]),
-			Map:     map[string]string{},
-		}
-		for k, v := range m {
-			op.Map[k] = string(v)
-		}
-		return op, nil
-	case "MSG":
-		if len(tokens) != 3 {
-			return ServerOperation{}, errors.New("MSG len(tokens) != 3")
-		}
-		payload, err := readPayload(d.reader, tokens[2])
-		if err != nil {
-			return ServerOperation{}, ErrParser{}
-		}
-		return ServerOperation{
-			Type:    TypeMessage,
-			Subject: tokens[1],
-			Payload: payload,
-		}, nil
-	case "+OK":
-		return ServerOperation{
-			Type: TypeOK,
-		}, nil
-	case "-ERR":
-		if len(tokens) != 2 {
-			return ServerOperation{}, errors.New("ERR len(tokens) != 2")
-		}
-		return ServerOperation{
-			Type:    TypeError,
-			Payload: []byte(strings.Trim(tokens[1], "'")),
-		}, nil
+func (c *Conn) publishOp(payload []byte) (*protocol.ClientOperation, error) {
+	if !subject.IsLiteral(c.subject) {
+		return nil, ErrInvalidSubject{c.subject}
+	}
+	if err := c.client.checkPayload(nil, payload); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.closing:
+		return nil, c.closeErr
+	default:
 	}
-	return ServerOperation{}, ErrParser{}
+	return &protocol.ClientOperation{
+		Type:    protocol.TypePublish,
+		Subject: c.subject,
+		Payload: payload,
+	}, nil
 }
 
-type clientEncoder struct {
-	writer io.Writer
+func (c *Conn) Receive() ([]byte, error) {
+	return c.ReceiveContext(context.Background())
 }
 
-func NewClientEncoder(writer io.Writer) *clientEncoder {
-	return &clientEncoder{
-		writer: writer,
+// ReceiveContext is like Receive, but gives up with ctx's error once ctx is
+// done.
+func (c *Conn) ReceiveContext(ctx context.Context) ([]byte, error) {
+	msg, err := c.ReceiveMsgContext(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return msg.Payload, nil
 }
 
-func (e *clientEncoder) Publish(subject string, payload []byte) error {
-	_, err := fmt.Fprintf(e.writer, "PUB %s %d\n%s\n", subject, len(payload), string(payload))
-	return err
+// ReceiveMsg is like Receive, but also returns the subject the message was
+// published on, its reply subject and headers. A response can be sent with
+// the client's Publish.
+func (c *Conn) ReceiveMsg() (*Msg, error) {
+	return c.ReceiveMsgContext(context.Background())
 }
 
-func (e *clientEncoder) Subscribe(subject string) error {
-	_, err := fmt.Fprintf(e.writer, "SUB %s\n", subject)
-	return err
+// ReceiveMsgContext is like ReceiveMsg, but gives up with ctx's error once
+// ctx is done.
+func (c *Conn) ReceiveMsgContext(ctx context.Context) (*Msg, error) {
+	select {
+	case <-c.closing:
+		return nil, c.closeErr
+	default:
+	}
+	select {
+	case msg := <-c.recv:
+		return msg, nil
+	case <-c.closing:
+		return nil, c.closeErr
+	case <-c.client.closing:
+		return nil, c.client.fatalErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the Conn from receiving. The client unsubscribes from the
+// subject when its last Conn is closed.
+func (c *Conn) Close() {
+	c.close(ErrConnClosed{})
+}
+
+func (c *Conn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.closeErr = err
+		c.client.unsubscribe(c)
+	})
 }
 
-func (e *clientEncoder) Unsubscribe(subject string) error {
-	_, err := fmt.Fprintf(e.writer, "UNSUB %s\n", subject)
-	return err
+// received passes msg on to Receive, or, if the buffer is full, follows the
+// Conn's SlowConsumerPolicy. It's called from the client's reader goroutine.
+func (c *Conn) received(msg *Msg) {
+	atomic.AddUint64(&c.recvMsgs, 1)
+	atomic.AddUint64(&c.recvBytes, uint64(len(msg.Payload)))
+	select {
+	case c.recv <- msg:
+		return
+	default:
+	}
+	switch c.policy {
+	case DropOldest:
+		for cap(c.recv) > 0 {
+			select {
+			case <-c.recv:
+				atomic.AddUint64(&c.droppedMsgs, 1)
+			default:
+			}
+			select {
+			case c.recv <- msg:
+				return
+			default:
+			}
+		}
+	case BlockReader:
+		select {
+		case c.recv <- msg:
+			return
+		case <-c.closing:
+		case <-c.client.closing:
+		}
+	case Disconnect:
+		// The drop is counted before the UNSUB goes out.
+		atomic.AddUint64(&c.droppedMsgs, 1)
+		c.close(ErrSlowConsumer{Reason: fmt.Sprintf("%d messages unread on %s", len(c.recv), c.subject)})
+		return
+	}
+	atomic.AddUint64(&c.droppedMsgs, 1)
 }
@@ -0,0 +1,541 @@
+package psycho
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn is the server end of a Client's connection. The ops the client
+// sends, other than CONNECT, are passed to ops.
+type fakeConn struct {
+	conn net.Conn
+	enc  *protocol.ServerEncoder
+	ops  chan protocol.ClientOperation
+}
+
+func dialFake() (*Client, *fakeConn) {
+	server, conn := net.Pipe()
+	c := NewClient(conn, conn, PingInterval(0))
+	return c, newFake(server)
+}
+
+// newFake serves a client on server, starting with INFO.
+func newFake(server net.Conn) *fakeConn {
+	f := &fakeConn{
+		conn: server,
+		enc:  protocol.NewServerEncoder(server),
+		ops:  make(chan protocol.ClientOperation, 100),
+	}
+	go func() {
+		dec := protocol.NewServerDecoder(server)
+		for {
+			op, err := dec.ReadOperation()
+			if err != nil {
+				close(f.ops)
+				return
+			}
+			if op.Type != protocol.TypeConnect {
+				f.ops <- op
+			}
+		}
+	}()
+	go f.enc.Info(map[string]interface{}{})
+	return f
+}
+
+func (f *fakeConn) expect(t *testing.T, want protocol.ClientOperation) {
+	select {
+	case op := <-f.ops:
+		assert.Equal(t, want, op)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %v received", want.Type)
+	}
+}
+
+// sync waits until the client has read everything sent to it so far.
+func (f *fakeConn) sync(t *testing.T) {
+	require.NoError(t, f.enc.Ping())
+	f.expect(t, protocol.ClientOperation{Type: protocol.TypePong})
+}
+
+func sub(subj string, sid uint64, queue string) protocol.ClientOperation {
+	return protocol.ClientOperation{Type: protocol.TypeSubscribe, Subject: subj, SID: sid, Queue: queue}
+}
+
+func unsub(subj string, sid uint64, queue string) protocol.ClientOperation {
+	return protocol.ClientOperation{Type: protocol.TypeUnsubscribe, Subject: subj, SID: sid, Queue: queue}
+}
+
+func TestClientSIDs(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+
+	// Conns on the same subject and queue group share a SID.
+	a1, err := c.Dial("foo")
+	require.NoError(t, err)
+	a2, err := c.Dial("foo")
+	require.NoError(t, err)
+	b, err := c.Dial("foo.*")
+	require.NoError(t, err)
+	q, err := c.DialQueue("foo", "workers")
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 1, ""))
+	f.expect(t, sub("foo.*", 2, ""))
+	f.expect(t, sub("foo", 3, "workers"))
+
+	// The SID is unsubscribed once its last Conn closes.
+	a1.Close()
+	a2.Close()
+	f.expect(t, unsub("foo", 1, ""))
+	b.Close()
+	f.expect(t, unsub("foo.*", 2, ""))
+
+	// SIDs aren't reused.
+	_, err = c.Dial("foo")
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 4, ""))
+	q.Close()
+	f.expect(t, unsub("foo", 3, "workers"))
+}
+
+func TestClientMsgRouting(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+
+	foo, err := c.Dial("foo")
+	require.NoError(t, err)
+	all, err := c.Dial(">")
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 1, ""))
+	f.expect(t, sub(">", 2, ""))
+
+	received := func() (uint64, uint64) {
+		return foo.Stats().Msgs, all.Stats().Msgs
+	}
+
+	// A SID picks the subscription, whatever the subject.
+	require.NoError(t, f.enc.Msg("foo", 2, "", nil, []byte("hi")))
+	f.sync(t)
+	fooN, allN := received()
+	assert.Equal(t, uint64(0), fooN)
+	assert.Equal(t, uint64(1), allN)
+
+	// Unknown SIDs are dropped.
+	require.NoError(t, f.enc.Msg("foo", 7, "", nil, []byte("hi")))
+	f.sync(t)
+	fooN, allN = received()
+	assert.Equal(t, uint64(0), fooN)
+	assert.Equal(t, uint64(1), allN)
+
+	// Without a SID, every matching subscription gets the message.
+	require.NoError(t, f.enc.Msg("foo", 0, "", nil, []byte("hi")))
+	f.sync(t)
+	fooN, allN = received()
+	assert.Equal(t, uint64(1), fooN)
+	assert.Equal(t, uint64(2), allN)
+}
+
+func TestClientDialClosed(t *testing.T) {
+	c, _ := dialFake()
+	require.NoError(t, c.Close())
+
+	_, err := c.Dial("foo")
+	assert.Equal(t, ErrConnClosed{}, err)
+	// The failed subscription isn't left behind.
+	c.RLock()
+	defer c.RUnlock()
+	assert.Empty(t, c.conns)
+	assert.Empty(t, c.sids)
+	assert.Zero(t, c.subs.Len())
+}
+
+// readTracker is a client's end of a connection that records whether a Read
+// is in progress. Reads take a while to return after the connection closes.
+type readTracker struct {
+	net.Conn
+	reading bool
+	mu      sync.Mutex
+}
+
+func (c *readTracker) Read(b []byte) (int, error) {
+	c.setReading(true)
+	defer c.setReading(false)
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return n, err
+}
+
+func (c *readTracker) setReading(reading bool) {
+	c.mu.Lock()
+	c.reading = reading
+	c.mu.Unlock()
+}
+
+func TestClientCloseWaitsForReader(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	tracker := &readTracker{Conn: conn}
+	c := NewClient(tracker, tracker, PingInterval(0))
+	assert.Eventually(t, func() bool {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		return tracker.reading
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, c.Close())
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	assert.False(t, tracker.reading)
+}
+
+func pub(subj string, payload string) protocol.ClientOperation {
+	return protocol.ClientOperation{Type: protocol.TypePublish, Subject: subj, Payload: []byte(payload)}
+}
+
+func TestClientReconnect(t *testing.T) {
+	// Each dial waits for next and serves the connection with a fakeConn.
+	next := make(chan struct{}, 1)
+	fakes := make(chan *fakeConn, 1)
+	dial := func() (io.ReadWriteCloser, error) {
+		<-next
+		server, conn := net.Pipe()
+		fakes <- newFake(server)
+		return conn, nil
+	}
+	disconnected := make(chan error, 1)
+	reconnected := make(chan struct{}, 1)
+
+	next <- struct{}{}
+	c, err := Connect(dial,
+		PingInterval(0),
+		ReconnectWait(time.Millisecond, time.Millisecond),
+		ReconnectBufSize(10),
+		DisconnectHandler(func(err error) { disconnected <- err }),
+		ReconnectHandler(func() { reconnected <- struct{}{} }),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+	f := <-fakes
+
+	foo, err := c.Dial("foo")
+	require.NoError(t, err)
+	_, err = c.DialQueue("bar", "workers")
+	require.NoError(t, err)
+	gone, err := c.Dial("gone")
+	require.NoError(t, err)
+	gone.Close()
+	f.expect(t, sub("foo", 1, ""))
+	f.expect(t, sub("bar", 2, "workers"))
+	f.expect(t, sub("gone", 3, ""))
+	f.expect(t, unsub("gone", 3, ""))
+
+	f.conn.Close()
+	assert.Equal(t, io.EOF, <-disconnected)
+	assert.NoError(t, c.Err())
+
+	// While reconnecting, publishes are held as long as they fit in the
+	// buffer, and subscriptions are made on the next connection.
+	assert.NoError(t, c.Publish("foo", []byte("held")))
+	assert.Equal(t, ErrDisconnected{}, c.Publish("foo", []byte("too much")))
+	_, err = c.Dial("baz")
+	require.NoError(t, err)
+	assert.Equal(t, ErrDisconnected{}, c.Flush(context.Background()))
+
+	next <- struct{}{}
+	f = <-fakes
+	<-reconnected
+	f.expect(t, sub("foo", 1, ""))
+	f.expect(t, sub("bar", 2, "workers"))
+	f.expect(t, sub("baz", 4, ""))
+	f.expect(t, pub("foo", "held"))
+
+	// The Conns receive on the new connection.
+	require.NoError(t, f.enc.Msg("foo", 1, "", nil, []byte("hi")))
+	f.sync(t)
+	assert.Equal(t, uint64(1), foo.Stats().Msgs)
+	require.NoError(t, c.Publish("foo", []byte("after")))
+	f.expect(t, pub("foo", "after"))
+}
+
+func TestClientReconnectGivesUp(t *testing.T) {
+	dialErr := errors.New("no route to host")
+	var dials int32
+	dial := func() (io.ReadWriteCloser, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			return nil, dialErr
+		}
+		server, conn := net.Pipe()
+		server.Close()
+		return conn, nil
+	}
+
+	c, err := Connect(dial, PingInterval(0), ReconnectWait(time.Millisecond, time.Millisecond), MaxReconnects(3))
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Eventually(t, func() bool { return c.Err() == dialErr }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&dials))
+
+	// Only the first dial's error is returned from Connect.
+	_, err = Connect(dial)
+	assert.Equal(t, dialErr, err)
+}
+
+func TestConnSlowConsumer(t *testing.T) {
+	receiveAll := func(conn *Conn) []string {
+		var got []string
+		for len(conn.recv) > 0 {
+			payload, err := conn.Receive()
+			require.NoError(t, err)
+			got = append(got, string(payload))
+		}
+		return got
+	}
+
+	tests := []struct {
+		policy  SlowConsumerPolicy
+		want    []string
+		dropped uint64
+	}{
+		{DropNewest, []string{"1", "2"}, 2},
+		{DropOldest, []string{"3", "4"}, 2},
+	}
+	for _, tt := range tests {
+		c, f := dialFake()
+		conn, err := c.Dial("foo", RecvBuffer(2), SlowConsumer(tt.policy))
+		require.NoError(t, err)
+		f.expect(t, sub("foo", 1, ""))
+		for _, payload := range []string{"1", "2", "3", "4"} {
+			require.NoError(t, f.enc.Msg("foo", 1, "", nil, []byte(payload)))
+		}
+		f.sync(t)
+		assert.Equal(t, tt.want, receiveAll(conn), "policy %v", tt.policy)
+		assert.Equal(t, ConnStats{Msgs: 4, Bytes: 4, Dropped: tt.dropped}, conn.Stats())
+		c.Close()
+	}
+}
+
+func TestConnSlowConsumerBlockReader(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+	conn, err := c.Dial("foo", RecvBuffer(1), SlowConsumer(BlockReader))
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 1, ""))
+
+	sent := make(chan struct{})
+	go func() {
+		for _, payload := range []string{"1", "2", "3"} {
+			f.enc.Msg("foo", 1, "", nil, []byte(payload))
+		}
+		close(sent)
+	}()
+	// The reader waits for room, so nothing is dropped.
+	for _, want := range []string{"1", "2", "3"} {
+		payload, err := conn.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(payload))
+	}
+	<-sent
+	assert.Equal(t, uint64(0), conn.Stats().Dropped)
+}
+
+func TestConnSlowConsumerDisconnect(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+	conn, err := c.Dial("foo", RecvBuffer(1), SlowConsumer(Disconnect))
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 1, ""))
+
+	require.NoError(t, f.enc.Msg("foo", 1, "", nil, []byte("1")))
+	require.NoError(t, f.enc.Msg("foo", 1, "", nil, []byte("2")))
+	f.expect(t, unsub("foo", 1, ""))
+	_, err = conn.Receive()
+	assert.IsType(t, ErrSlowConsumer{}, err)
+	assert.Equal(t, uint64(1), conn.Stats().Dropped)
+	assert.IsType(t, ErrSlowConsumer{}, conn.Send(nil))
+}
+
+// dialStalled returns a client and the server end of its connection, on
+// which CONNECT has been read. The server reads nothing more unless the test
+// does, like a server blocked on writing to the client.
+func dialStalled(t *testing.T) (*Client, *protocol.ServerEncoder, *protocol.ServerDecoder) {
+	server, conn := net.Pipe()
+	c := NewClient(conn, conn, PingInterval(0))
+	t.Cleanup(func() { c.Close() })
+	enc, dec := protocol.NewServerEncoder(server), protocol.NewServerDecoder(server)
+	go enc.Info(map[string]interface{}{})
+	op, err := dec.ReadOperation()
+	require.NoError(t, err)
+	require.Equal(t, protocol.TypeConnect, op.Type)
+	return c, enc, dec
+}
+
+// expectSent checks that send returns, which it doesn't while the client has
+// stopped reading.
+func expectSent(t *testing.T, send func() error) {
+	sent := make(chan error, 1)
+	go func() { sent <- send() }()
+	select {
+	case err := <-sent:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client stopped reading")
+	}
+}
+
+func TestClientPongDoesntBlockReader(t *testing.T) {
+	_, enc, _ := dialStalled(t)
+	// The writer blocks on the first PONG, and the reader reads on.
+	expectSent(t, func() error {
+		for i := 0; i < 3; i++ {
+			if err := enc.Ping(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestConnSlowConsumerDisconnectDoesntBlockReader(t *testing.T) {
+	c, enc, dec := dialStalled(t)
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := c.Dial("foo", RecvBuffer(1), SlowConsumer(Disconnect))
+		dialed <- err
+	}()
+	op, err := dec.ReadOperation()
+	require.NoError(t, err)
+	require.Equal(t, sub("foo", 1, ""), op)
+	require.NoError(t, <-dialed)
+
+	// The writer blocks on the PONG, and then the reader has to UNSUB.
+	expectSent(t, func() error {
+		if err := enc.Ping(); err != nil {
+			return err
+		}
+		for _, payload := range []string{"1", "2", "3"} {
+			if err := enc.Msg("foo", 1, "", nil, []byte(payload)); err != nil {
+				return err
+			}
+		}
+		return enc.Ping()
+	})
+}
+
+func TestClientContext(t *testing.T) {
+	// Without INFO from the server, the client never sends anything.
+	server, conn := net.Pipe()
+	defer server.Close()
+	c := NewClient(conn, conn, PingInterval(0))
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := c.InfoContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = c.DialContext(ctx, "foo")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// The SUB that wasn't sent isn't left behind either.
+	c.RLock()
+	assert.Empty(t, c.conns)
+	c.RUnlock()
+	_, err = c.RequestContext(ctx, "foo", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestConnContext(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+	conn, err := c.Dial("foo")
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 1, ""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = conn.ReceiveContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	// A message that can be sent at once is sent whatever the context.
+	assert.NoError(t, conn.SendContext(context.Background(), []byte("hi")))
+	f.expect(t, pub("foo", "hi"))
+}
+
+func TestClientRequestContext(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.RequestContext(ctx, "foo", []byte("hi"))
+		errs <- err
+	}()
+	op := <-f.ops
+	require.Equal(t, protocol.TypeSubscribe, op.Type)
+	inbox := op.Subject
+	f.expect(t, protocol.ClientOperation{Type: protocol.TypePublish, Subject: "foo", Reply: inbox, Payload: []byte("hi")})
+
+	// Once the context is done, the inbox is unsubscribed.
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	f.expect(t, unsub(inbox, op.SID, ""))
+}
+
+func TestClientFlush(t *testing.T) {
+	c, f := dialFake()
+	defer c.Close()
+
+	require.NoError(t, c.Publish("foo", []byte("hi")))
+	flushed := make(chan error, 1)
+	go func() { flushed <- c.Flush(context.Background()) }()
+	f.expect(t, pub("foo", "hi"))
+	f.expect(t, protocol.ClientOperation{Type: protocol.TypePing})
+	select {
+	case err := <-flushed:
+		t.Fatalf("flushed before the PONG: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, f.enc.Pong())
+	assert.NoError(t, <-flushed)
+}
+
+func TestConnSendSync(t *testing.T) {
+	var handled []error
+	server, conn := net.Pipe()
+	c := NewClient(conn, conn, PingInterval(0), ErrorHandler(func(err error) { handled = append(handled, err) }))
+	defer c.Close()
+	f := newFake(server)
+	foo, err := c.Dial("foo")
+	require.NoError(t, err)
+	f.expect(t, sub("foo", 1, ""))
+
+	// The SUB is pinged first, so that the errors before the last PONG are
+	// about the publish alone.
+	sent := make(chan error, 1)
+	go func() { sent <- foo.SendSync(context.Background(), []byte("hi")) }()
+	f.expect(t, protocol.ClientOperation{Type: protocol.TypePing})
+	f.expect(t, pub("foo", "hi"))
+	f.expect(t, protocol.ClientOperation{Type: protocol.TypePing})
+	require.NoError(t, f.enc.Pong())
+	require.NoError(t, f.enc.Err(ErrPermissionDenied{Reason: "foo"}))
+	require.NoError(t, f.enc.Pong())
+	assert.Equal(t, ErrPermissionDenied{Reason: "foo"}, <-sent)
+
+	go func() { sent <- foo.SendSync(context.Background(), []byte("hi")) }()
+	f.expect(t, pub("foo", "hi"))
+	f.expect(t, protocol.ClientOperation{Type: protocol.TypePing})
+	require.NoError(t, f.enc.Pong())
+	assert.NoError(t, <-sent)
+	// The error went to SendSync instead of the ErrorHandler.
+	assert.Empty(t, handled)
+}
@@ -1,142 +1,303 @@
 package psycho
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
-	"errors"
-	"fmt"
+	"context"
 	"io"
-	"strconv"
-	"strings"
+	"math/rand"
+	"sync"
+
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/subject"
 )
 
+// ServerCodec serves the text protocol on top of a Server. Since a Server only
+// knows about subjects, the codec keeps track of the client's subscription
+// IDs itself: it subscribes the Server to a subject once, however many SIDs
+// share it, and fans every message out to each matching SID. Servers that
+// deliver a message once per server-side subscription should do so through
+// HandleSubMsg. Queue groups are passed on to servers that implement
+// QueueServer, but the codec still picks a single member of a group for each
+// message.
 type ServerCodec struct {
-	reader *bufio.Reader
-	writer io.Writer
+	dec *protocol.ServerDecoder
+	enc *protocol.ServerEncoder
+
+	subs   map[subKey]struct{}
+	refs   map[subKey]int
+	trie   *subject.Trie
+	queues bool
+	mu     sync.Mutex
+
+	auth func(*ConnectOptions) bool
+
+	// closers are the reader and writer, if they can be closed.
+	closers []io.Closer
+}
+
+type subKey struct {
+	subject string
+	queue   string
+	sid     uint64
 }
 
 func NewServerCodec(reader io.Reader, writer io.Writer) *ServerCodec {
 	c := &ServerCodec{
-		reader: bufio.NewReader(reader),
-		writer: writer,
+		dec: protocol.NewServerDecoder(reader),
+		enc: protocol.NewServerEncoder(writer),
+
+		subs: map[subKey]struct{}{},
+		refs: map[subKey]int{},
+		trie: subject.NewTrie(),
+	}
+	for _, rw := range []interface{}{reader, writer} {
+		if closer, ok := rw.(io.Closer); ok {
+			c.closers = append(c.closers, closer)
+		}
 	}
 	return c
 }
 
-func (c *ServerCodec) HandleInfo(info map[string]interface{}) {
-	m, err := json.Marshal(info)
-	if err != nil {
-		c.writer.Write([]byte(`INFO {"error": "error marshalling info"}\n`))
-		return
-	}
-	fmt.Fprintf(c.writer, "INFO %s\n", m)
+// RequireAuth makes the codec advertise auth_required in INFO and reject any
+// op until the client sends a CONNECT whose options pass check. It must be
+// called before the codec is used.
+func (c *ServerCodec) RequireAuth(check func(*ConnectOptions) bool) {
+	c.auth = check
 }
 
-func (c *ServerCodec) HandleMsg(subject string, payload []byte) {
-	buf := bytes.NewBuffer(make([]byte, 0, len(payload)+len(subject)+16))
-	fmt.Fprintf(buf, "MSG %s %d\n", subject, len(payload))
-	buf.Write(payload)
-	buf.WriteRune('\n')
-	c.writer.Write(buf.Bytes())
+// SetMaxPayload sets the largest payload, headers included, the codec accepts
+// from the client. A server that advertises a smaller max_payload in its INFO
+// lowers it further. It must be called before the codec is used.
+func (c *ServerCodec) SetMaxPayload(n int) {
+	c.dec.SetMaxPayload(n)
 }
 
-func (c *ServerCodec) ServeClientOpsTo(server Server) {
-	for {
-		op, subject, payload, err := c.readMsg()
-		if err != nil {
-			if err == io.EOF {
-				return
-			}
-			fmt.Fprintf(c.writer, "-ERR %q\n", err.Error())
-			continue
-		}
-		switch op {
-		case pub:
-			server.Pub(subject, payload)
-		case sub:
-			server.Sub(subject)
-		case unsub:
-			server.Unsub(subject)
+func (c *ServerCodec) HandleInfo(info map[string]interface{}) {
+	if n, ok := info["max_payload"].(int); ok && n < c.dec.MaxPayload() {
+		c.dec.SetMaxPayload(n)
+	}
+	withCodec := map[string]interface{}{
+		"max_payload": c.dec.MaxPayload(),
+		"encodings":   protocol.Encodings,
+	}
+	if c.auth != nil {
+		withCodec["auth_required"] = true
+	}
+	for k, v := range info {
+		if _, ok := withCodec[k]; !ok {
+			withCodec[k] = v
 		}
-		c.writer.Write([]byte("+OK\n"))
+	}
+	if err := c.enc.Info(withCodec); err != nil {
+		c.enc.Info(map[string]interface{}{"error": "error marshalling info"})
 	}
 }
 
-type opname string
+func (c *ServerCodec) HandleMsg(subj string, payload []byte) {
+	c.HandleHeaderMsg(subj, "", nil, payload)
+}
 
-const (
-	pub   opname = "PUB"
-	sub   opname = "SUB"
-	unsub opname = "UNSUB"
-)
+func (c *ServerCodec) HandleReplyMsg(subj, reply string, payload []byte) {
+	c.HandleHeaderMsg(subj, reply, nil, payload)
+}
 
-func (c *ServerCodec) readLine() ([]byte, error) {
-	line, err := c.reader.ReadBytes('\n')
-	if err != nil {
-		return nil, err
+func (c *ServerCodec) HandleHeaderMsg(subj, reply string, header Header, payload []byte) {
+	var keys []subKey
+	for _, v := range c.trie.Match(subj) {
+		keys = append(keys, v.(subKey))
 	}
-	line = line[:len(line)-1]
-	if len(line) > 0 && line[len(line)-1] == '\r' {
-		line = line[:len(line)-1]
-	}
-	return line, nil
+	c.deliver(keys, subj, reply, header, payload)
 }
 
-func (c *ServerCodec) readMsg() (opname, string, []byte, error) {
-
-	line, err := c.readLine()
-	if err != nil {
-		return "", "", nil, err
+// HandleSubMsg delivers a message only to the subscriptions that share the
+// server-side subscription to pattern and queue, so that servers delivering a
+// copy per server-side subscription don't deliver any SID a message twice.
+func (c *ServerCodec) HandleSubMsg(pattern, queue, subj, reply string, header Header, payload []byte) {
+	ref := subKey{subject: pattern, queue: queue}
+	var keys []subKey
+	c.mu.Lock()
+	for _, v := range c.trie.Match(subj) {
+		if key := v.(subKey); c.ref(key) == ref {
+			keys = append(keys, key)
+		}
 	}
+	c.mu.Unlock()
+	c.deliver(keys, subj, reply, header, payload)
+}
 
-	if len(line) == 0 {
-		return "", "", nil, errors.New("empty line")
+// deliver sends a message to each of keys, except that of the keys in the
+// same queue group, which is a subject and a queue name, only one gets it.
+func (c *ServerCodec) deliver(keys []subKey, subj, reply string, header Header, payload []byte) {
+	groups := map[subKey][]subKey{}
+	for _, key := range keys {
+		if key.queue != "" {
+			group := subKey{subject: key.subject, queue: key.queue}
+			groups[group] = append(groups[group], key)
+			continue
+		}
+		c.enc.Msg(subj, key.sid, reply, header, payload)
 	}
+	for _, members := range groups {
+		key := members[rand.Intn(len(members))]
+		c.enc.Msg(subj, key.sid, reply, header, payload)
+	}
+}
 
-	tokens := strings.Split(string(line), " ")
+// ServeClientOpsTo reads the client's ops and carries them out on server
+// until the client is gone. Ops that can't be carried out are answered with
+// -ERR, and if the error is fatal, serving stops. Either way the codec's
+// reader and writer are closed, if they can be, when it returns.
+func (c *ServerCodec) ServeClientOpsTo(server Server) {
+	_, queues := server.(QueueServer)
+	c.serve(context.Background(), AdaptServer(server), queues)
+}
 
-	switch opname(tokens[0]) {
-	case pub:
-		if len(tokens) != 3 {
-			return "", "", nil, fmt.Errorf("PUB op expects exactly 2 arguments, found %d", len(tokens)-1)
+// ServeClientOpsToV2 is ServeClientOpsTo for a ServerV2, passing it ctx with
+// every op. Ops the server fails are answered with -ERR instead of +OK, as
+// ErrOpFailed unless the error is a non-fatal one of the protocol's. Serving
+// also stops once ctx is done.
+func (c *ServerCodec) ServeClientOpsToV2(ctx context.Context, server ServerV2) {
+	c.serve(ctx, server, true)
+}
+
+// serve carries out the client's ops on server. Queues tells whether server
+// tells queue groups apart.
+func (c *ServerCodec) serve(ctx context.Context, server ServerV2, queues bool) {
+	defer c.close()
+	if ctx.Done() != nil {
+		// Closing the reader unblocks ReadOperation.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.close()
+			case <-done:
+			}
+		}()
+	}
+	c.mu.Lock()
+	c.queues = queues
+	c.mu.Unlock()
+	authorized := c.auth == nil
+	verbose := true
+	for {
+		op, err := c.dec.ReadOperation()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			c.enc.Err(err)
+			if IsFatal(err) {
+				return
+			}
+			continue
+		}
+		if op.Type == protocol.TypeConnect {
+			verbose = op.Connect.Verbose
+			if c.auth != nil {
+				authorized = c.auth(op.Connect)
+			}
+		}
+		if !authorized {
+			c.enc.Err(ErrAuthorization{})
+			return
+		}
+		switch op.Type {
+		case protocol.TypeConnect:
+			if err := c.enc.SetEncoding(op.Connect.Encoding); err != nil {
+				c.enc.Err(err)
+				return
+			}
+		case protocol.TypePing:
+			c.enc.Pong()
+			continue
+		case protocol.TypePong:
+			continue
+		case protocol.TypePublish:
+			err = server.Pub(ctx, op.Subject, op.Reply, op.Header, op.Payload)
+		case protocol.TypeSubscribe:
+			key := subKey{op.Subject, op.Queue, op.SID}
+			ref, first := c.subscribe(key)
+			if !first {
+				break
+			}
+			if err = server.Sub(ctx, ref.subject, ref.queue); err != nil {
+				c.unsubscribe(key)
+			}
+		case protocol.TypeUnsubscribe:
+			ref, last := c.unsubscribe(subKey{op.Subject, op.Queue, op.SID})
+			if last {
+				err = server.Unsub(ctx, ref.subject, ref.queue)
+			}
 		}
-		payload, err := readPayload(c.reader, tokens[2])
-		return pub, tokens[1], payload, err
-	case sub:
-		if len(tokens) != 2 {
-			return "", "", nil, fmt.Errorf("SUB op expects exactly 1 argument, found %d", len(tokens)-1)
+		if err != nil {
+			c.enc.Err(opErr(err))
+			continue
 		}
-		return sub, tokens[1], nil, nil
-	case unsub:
-		if len(tokens) != 2 {
-			return "", "", nil, fmt.Errorf("UNSUB op expects exactly 1 argument, found %d", len(tokens)-1)
+		if verbose {
+			c.enc.OK()
 		}
-		return unsub, tokens[1], nil, nil
-	default:
-		return "", "", nil, errors.New("unknown op name")
 	}
 }
 
-func readPayload(reader *bufio.Reader, nbytes string) ([]byte, error) {
-	n, err := strconv.ParseUint(nbytes, 10, 64)
-	if err != nil {
-		return nil, errors.New("parsing number of bytes")
+// close closes the codec's reader and writer, if they can be.
+func (c *ServerCodec) close() {
+	for _, closer := range c.closers {
+		closer.Close()
 	}
-	var payload = make([]byte, n)
-	nread, err := reader.Read(payload)
-	if nread < int(n) {
-		return nil, fmt.Errorf("expected to read %d bytes, but only read %d", n, nread)
+}
+
+// opErr returns the error to send the client for err, which a server failed
+// an op with. Errors that would end the connection, or that have no code of
+// their own, are sent as ErrOpFailed.
+func opErr(err error) error {
+	switch err.(type) {
+	case ErrPermissionDenied, ErrSlowConsumer, ErrOpFailed:
+		return err
+	}
+	return ErrOpFailed{Reason: err.Error()}
+}
+
+// ref returns the key of the server-side subscription that key shares with
+// others. Servers without queue group support are subscribed to the plain
+// subject.
+func (c *ServerCodec) ref(key subKey) subKey {
+	if !c.queues {
+		return subKey{subject: key.subject}
 	}
-	if err != nil {
-		return nil, err
+	return subKey{subject: key.subject, queue: key.queue}
+}
+
+// subscribe registers key and reports whether it's the first subscription
+// that needs the server-side subscription ref.
+func (c *ServerCodec) subscribe(key subKey) (ref subKey, first bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ref = c.ref(key)
+	if _, ok := c.subs[key]; ok {
+		return ref, false
 	}
-	delim, err := reader.ReadString('\n')
-	if !(delim == "\n" || delim == "\r\n") {
-		return nil, fmt.Errorf("payload did not end with a new line")
+	c.subs[key] = struct{}{}
+	c.trie.Insert(key.subject, key)
+	c.refs[ref]++
+	return ref, c.refs[ref] == 1
+}
+
+// unsubscribe removes key and reports whether it was the last subscription
+// that needed the server-side subscription ref.
+func (c *ServerCodec) unsubscribe(key subKey) (ref subKey, last bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ref = c.ref(key)
+	if _, ok := c.subs[key]; !ok {
+		return ref, false
 	}
-	if err != nil {
-		return nil, err
+	delete(c.subs, key)
+	c.trie.Remove(key.subject, key)
+	c.refs[ref]--
+	if c.refs[ref] > 0 {
+		return ref, false
 	}
-	return payload, nil
+	delete(c.refs, ref)
+	return ref, true
 }
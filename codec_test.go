@@ -0,0 +1,224 @@
+package psycho
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/subject"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer delivers each message once if perSub is false, like Multicast
+// does, or a copy for every subscription it matches if perSub is true, like
+// NATS does.
+type fakeServer struct {
+	perSub  bool
+	subs    []fakeSub
+	handler Handler
+	mu      sync.Mutex
+}
+
+type fakeSub struct {
+	pattern string
+	queue   string
+}
+
+func (s *fakeServer) Pub(subj string, payload []byte) {
+	s.mu.Lock()
+	subs := append([]fakeSub(nil), s.subs...)
+	s.mu.Unlock()
+	for _, sub := range subs {
+		if !subject.Match(sub.pattern, subj) {
+			continue
+		}
+		if !s.perSub {
+			Deliver(s.handler, subj, "", nil, payload)
+			return
+		}
+		DeliverSub(s.handler, sub.pattern, sub.queue, subj, "", nil, payload)
+	}
+}
+
+func (s *fakeServer) Sub(subj string)   { s.QueueSub(subj, "") }
+func (s *fakeServer) Unsub(subj string) { s.QueueUnsub(subj, "") }
+
+func (s *fakeServer) QueueSub(subj, queue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, fakeSub{subj, queue})
+}
+
+func (s *fakeServer) QueueUnsub(subj, queue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.subs {
+		if sub == (fakeSub{subj, queue}) {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *fakeServer) ServeServerOpsTo(handler Handler) {
+	s.handler = handler
+	handler.HandleInfo(map[string]interface{}{})
+}
+
+// serveCodec sends ops to a ServerCodec on top of server, followed by a PING,
+// and returns the SIDs of the messages the codec sends back before the PONG.
+func serveCodec(t *testing.T, server Server, ops string) []uint64 {
+	clientR, clientW := io.Pipe()
+	codecR, codecW := io.Pipe()
+	codec := NewServerCodec(clientR, codecW)
+	defer clientW.Close()
+
+	sids := make(chan []uint64, 1)
+	go func() {
+		var got []uint64
+		defer func() { sids <- got }()
+		dec := protocol.NewClientDecoder(codecR)
+		for {
+			op, err := dec.ReadOperation()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch op.Type {
+			case protocol.TypeMessage:
+				got = append(got, op.SID)
+			case protocol.TypeServerPong:
+				return
+			}
+		}
+	}()
+
+	server.ServeServerOpsTo(codec)
+	go codec.ServeClientOpsTo(server)
+	_, err := io.WriteString(clientW, ops+"PING\n")
+	require.NoError(t, err)
+
+	got := <-sids
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	return got
+}
+
+func TestServerCodecOverlappingSubs(t *testing.T) {
+	got := serveCodec(t, &fakeServer{perSub: true}, "SUB a.* 1\nSUB a.b 2\nSUB a.> 3\nPUB a.b 2\nhi\n")
+	assert.Equal(t, []uint64{1, 2, 3}, got)
+}
+
+func TestServerCodecQueueGroups(t *testing.T) {
+	// SID 1 is outside of any group, 2 and 3 are in group g on foo, and 4 is
+	// in a group of the same name on another subject.
+	ops := "SUB foo 1\nSUB foo 2 g\nSUB foo 3 g\nSUB > 4 g\n"
+	const n = 30
+	for i := 0; i < n; i++ {
+		ops += "PUB foo 2\nhi\n"
+	}
+	for _, perSub := range []bool{false, true} {
+		got := serveCodec(t, &fakeServer{perSub: perSub}, ops)
+		counts := map[uint64]int{}
+		for _, sid := range got {
+			counts[sid]++
+		}
+		assert.Equal(t, n, counts[1])
+		assert.Equal(t, n, counts[2]+counts[3])
+		assert.NotZero(t, counts[2])
+		assert.NotZero(t, counts[3])
+		assert.Equal(t, n, counts[4])
+	}
+}
+
+func TestServerCodecClosesOnFatalError(t *testing.T) {
+	server, conn := net.Pipe()
+	go NewServerCodec(server, server).ServeClientOpsTo(&fakeServer{})
+	go io.WriteString(conn, "BOGUS\n")
+
+	dec := protocol.NewClientDecoder(conn)
+	op, err := dec.ReadOperation()
+	require.NoError(t, err)
+	assert.Equal(t, protocol.CodeParse, op.Code)
+	_, err = dec.ReadOperation()
+	assert.Equal(t, io.EOF, err)
+}
+
+// infoHandler passes on the INFO it receives and ignores messages.
+type infoHandler chan map[string]interface{}
+
+func (h infoHandler) HandleInfo(info map[string]interface{}) { h <- info }
+func (h infoHandler) HandleMsg(string, []byte)               {}
+
+// failingServer fails every op on the subject fail.
+type failingServer struct {
+	ServerV2
+}
+
+func (s failingServer) Pub(ctx context.Context, subj, reply string, header Header, payload []byte) error {
+	if subj == "fail" {
+		return errors.New("network is down")
+	}
+	return s.ServerV2.Pub(ctx, subj, reply, header, payload)
+}
+
+func (s failingServer) Sub(ctx context.Context, subj, queue string) error {
+	if subj == "fail" {
+		return errors.New("network is down")
+	}
+	return s.ServerV2.Sub(ctx, subj, queue)
+}
+
+func TestServerCodecV2OpFailed(t *testing.T) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go NewServerCodec(server, server).ServeClientOpsToV2(context.Background(), failingServer{AdaptServer(&fakeServer{})})
+	go io.WriteString(conn, "SUB fail 1\nPUB fail 2\nhi\nSUB foo 2\n")
+
+	dec := protocol.NewClientDecoder(conn)
+	expect := func(typ protocol.ServerOpType) protocol.ServerOperation {
+		for {
+			op, err := dec.ReadOperation()
+			require.NoError(t, err)
+			if op.Type != protocol.TypeInfo {
+				require.Equal(t, typ, op.Type)
+				return op
+			}
+		}
+	}
+	// Failed ops are answered with a non-fatal -ERR instead of +OK.
+	for i := 0; i < 2; i++ {
+		op := expect(protocol.TypeError)
+		assert.Equal(t, protocol.CodeOpFailed, op.Code)
+		assert.Equal(t, ErrOpFailed{Reason: "network is down"}, op.Err)
+	}
+	expect(protocol.TypeOK)
+}
+
+func TestAdaptServer(t *testing.T) {
+	fake := &fakeServer{}
+	server := AdaptServer(fake)
+	ctx := context.Background()
+
+	// Subscribing twice is the same as once.
+	require.NoError(t, server.Sub(ctx, "foo", ""))
+	require.NoError(t, server.Sub(ctx, "foo", ""))
+	require.NoError(t, server.Sub(ctx, "foo", "g"))
+	assert.Equal(t, []fakeSub{{"foo", ""}, {"foo", "g"}}, fake.subs)
+	require.NoError(t, server.Unsub(ctx, "foo", ""))
+	assert.Equal(t, []fakeSub{{"foo", "g"}}, fake.subs)
+
+	served := make(chan error, 1)
+	info := make(infoHandler, 1)
+	go func() { served <- server.ServeServerOpsTo(info) }()
+	<-info
+	require.NoError(t, server.Close())
+	assert.NoError(t, <-served)
+	assert.Equal(t, ErrServerClosed{}, server.Pub(ctx, "foo", "", nil, nil))
+	assert.Equal(t, ErrServerClosed{}, server.Close())
+}
@@ -0,0 +1,20 @@
+package psycho
+
+import "github.com/Gaboose/psycho/protocol"
+
+// The errors servers send in -ERR ops. See the protocol package for their
+// codes.
+type (
+	ErrParser           = protocol.ErrParser
+	ErrPayloadTooLarge  = protocol.ErrPayloadTooLarge
+	ErrAuthorization    = protocol.ErrAuthorization
+	ErrPermissionDenied = protocol.ErrPermissionDenied
+	ErrSlowConsumer     = protocol.ErrSlowConsumer
+	ErrOpFailed         = protocol.ErrOpFailed
+	ErrServer           = protocol.ErrServer
+)
+
+// IsFatal reports whether err, received from a server, ends the connection.
+func IsFatal(err error) bool {
+	return protocol.IsFatal(err)
+}
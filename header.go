@@ -0,0 +1,7 @@
+package psycho
+
+import "github.com/Gaboose/psycho/protocol"
+
+// Header holds the key-value pairs sent with HPUB and HMSG ops. See
+// protocol.Header.
+type Header = protocol.Header
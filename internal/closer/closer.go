@@ -0,0 +1,50 @@
+// Package closer has what the psycho.ServerV2 implementations share to shut
+// down once.
+package closer
+
+import (
+	"context"
+	"sync"
+)
+
+// ErrServerClosed is returned by the ops of a closed server. It's aliased as
+// psycho.ErrServerClosed.
+type ErrServerClosed struct{}
+
+func (e ErrServerClosed) Error() string { return "psycho: using a closed server" }
+
+// Closer tracks whether a server was closed. The zero value is an open
+// server's.
+type Closer struct {
+	closing   chan struct{}
+	initOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// Closing returns a channel that's closed once the server is.
+func (c *Closer) Closing() <-chan struct{} {
+	c.initOnce.Do(func() { c.closing = make(chan struct{}) })
+	return c.closing
+}
+
+// Close marks the server closed and calls fn the first time it's called,
+// and returns fn's error. Later calls return ErrServerClosed.
+func (c *Closer) Close(fn func() error) error {
+	c.Closing()
+	err := error(ErrServerClosed{})
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		err = fn()
+	})
+	return err
+}
+
+// Check returns the error for an op on a closed server or with a done ctx.
+func (c *Closer) Check(ctx context.Context) error {
+	select {
+	case <-c.Closing():
+		return ErrServerClosed{}
+	default:
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,29 @@
+package closer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloser(t *testing.T) {
+	var c Closer
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, c.Check(ctx))
+	cancel()
+	assert.Equal(t, context.Canceled, c.Check(ctx))
+
+	closeErr := errors.New("close failed")
+	calls := 0
+	fn := func() error {
+		calls++
+		return closeErr
+	}
+	assert.Equal(t, closeErr, c.Close(fn))
+	assert.Equal(t, ErrServerClosed{}, c.Close(fn))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, ErrServerClosed{}, c.Check(context.Background()))
+	<-c.Closing()
+}
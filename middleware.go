@@ -0,0 +1,96 @@
+package psycho
+
+// ServerMiddleware wraps a server, to act on the ops a client carries out on
+// it. The ServerV2 it returns usually embeds the one it's given and overrides
+// some of its methods.
+type ServerMiddleware func(ServerV2) ServerV2
+
+// HandlerMiddleware wraps the delivery of messages from a server to its
+// handler: the function it returns gets every message and passes those it
+// lets through on to next.
+type HandlerMiddleware func(next DeliverFunc) DeliverFunc
+
+// DeliverFunc delivers a message that arrived for the server's subscription
+// to pattern in queue. Pattern and queue are empty if the server didn't say
+// which subscription it was, as servers that deliver a message only once
+// don't.
+type DeliverFunc func(pattern, queue string, msg *Msg)
+
+// Middleware is a pair of server and handler middlewares that go together,
+// such as those that compress payloads on the way out and decompress them on
+// the way in, and Info, which sees the server's INFO before the handler does.
+// Any may be nil.
+type Middleware struct {
+	Server  ServerMiddleware
+	Handler HandlerMiddleware
+	Info    func(info map[string]interface{})
+}
+
+// Chain wraps server in middlewares, the first outermost: ops pass through
+// the middlewares in order, and messages on their way to the handler in
+// reverse.
+func Chain(server ServerV2, middlewares ...Middleware) ServerV2 {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		m := middlewares[i]
+		if m.Handler != nil || m.Info != nil {
+			server = &handlerChain{ServerV2: server, middleware: m.Handler, info: m.Info}
+		}
+		if m.Server != nil {
+			server = m.Server(server)
+		}
+	}
+	return server
+}
+
+// handlerChain wraps the handler of ServeServerOpsTo in middleware, and shows
+// info the INFO. Either may be nil.
+type handlerChain struct {
+	ServerV2
+	middleware HandlerMiddleware
+	info       func(info map[string]interface{})
+}
+
+func (c *handlerChain) ServeServerOpsTo(handler Handler) error {
+	deliver := DeliverFunc(func(pattern, queue string, msg *Msg) {
+		if pattern == "" {
+			Deliver(handler, msg.Subject, msg.Reply, msg.Header, msg.Payload)
+			return
+		}
+		DeliverSub(handler, pattern, queue, msg.Subject, msg.Reply, msg.Header, msg.Payload)
+	})
+	if c.middleware != nil {
+		deliver = c.middleware(deliver)
+	}
+	return c.ServerV2.ServeServerOpsTo(chainHandler{handler, deliver, c.info})
+}
+
+// chainHandler passes messages through deliver, and the INFO through info, if
+// set, on to the handler.
+type chainHandler struct {
+	Handler
+	deliver DeliverFunc
+	info    func(info map[string]interface{})
+}
+
+func (h chainHandler) HandleInfo(info map[string]interface{}) {
+	if h.info != nil {
+		h.info(info)
+	}
+	h.Handler.HandleInfo(info)
+}
+
+func (h chainHandler) HandleMsg(subj string, payload []byte) {
+	h.deliver("", "", &Msg{Subject: subj, Payload: payload})
+}
+
+func (h chainHandler) HandleReplyMsg(subj, reply string, payload []byte) {
+	h.deliver("", "", &Msg{Subject: subj, Reply: reply, Payload: payload})
+}
+
+func (h chainHandler) HandleHeaderMsg(subj, reply string, header Header, payload []byte) {
+	h.deliver("", "", &Msg{Subject: subj, Reply: reply, Header: header, Payload: payload})
+}
+
+func (h chainHandler) HandleSubMsg(pattern, queue, subj, reply string, header Header, payload []byte) {
+	h.deliver(pattern, queue, &Msg{Subject: subj, Reply: reply, Header: header, Payload: payload})
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Gaboose/psycho"
+)
+
+// Metrics counts the messages and bytes that pass through its Middleware,
+// by subject.
+type Metrics struct {
+	subjects map[string]*SubjectMetrics
+	mu       sync.Mutex
+}
+
+// SubjectMetrics are the counts for one subject. Bytes are those of
+// payloads.
+type SubjectMetrics struct {
+	Published      uint64
+	PublishedBytes uint64
+	Delivered      uint64
+	DeliveredBytes uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{subjects: map[string]*SubjectMetrics{}}
+}
+
+// Middleware returns a middleware that counts the messages published
+// successfully and those delivered.
+func (m *Metrics) Middleware() psycho.Middleware {
+	return psycho.Middleware{
+		Server: func(server psycho.ServerV2) psycho.ServerV2 {
+			return metricsServer{server, m}
+		},
+		Handler: func(next psycho.DeliverFunc) psycho.DeliverFunc {
+			return func(pattern, queue string, msg *psycho.Msg) {
+				m.mu.Lock()
+				s := m.subject(msg.Subject)
+				s.Delivered++
+				s.DeliveredBytes += uint64(len(msg.Payload))
+				m.mu.Unlock()
+				next(pattern, queue, msg)
+			}
+		},
+	}
+}
+
+// Subjects returns the counts so far of every subject.
+func (m *Metrics) Subjects() map[string]SubjectMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subjects := map[string]SubjectMetrics{}
+	for subj, s := range m.subjects {
+		subjects[subj] = *s
+	}
+	return subjects
+}
+
+// subject returns the counts of subj, which m.mu guards.
+func (m *Metrics) subject(subj string) *SubjectMetrics {
+	s, ok := m.subjects[subj]
+	if !ok {
+		s = &SubjectMetrics{}
+		m.subjects[subj] = s
+	}
+	return s
+}
+
+type metricsServer struct {
+	psycho.ServerV2
+	metrics *Metrics
+}
+
+func (s metricsServer) Pub(ctx context.Context, subj, reply string, header psycho.Header, payload []byte) error {
+	if err := s.ServerV2.Pub(ctx, subj, reply, header, payload); err != nil {
+		return err
+	}
+	s.metrics.mu.Lock()
+	m := s.metrics.subject(subj)
+	m.Published++
+	m.PublishedBytes += uint64(len(payload))
+	s.metrics.mu.Unlock()
+	return nil
+}
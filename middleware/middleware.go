@@ -0,0 +1,120 @@
+// Package middleware has psycho.Middleware to log, count, filter and
+// transform what passes between clients and a server. Chain them with
+// psycho.Chain.
+package middleware
+
+import (
+	"context"
+	"log"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/subject"
+)
+
+// Logging logs every op carried out on the server, and every message it
+// delivers, to logger.
+func Logging(logger *log.Logger) psycho.Middleware {
+	return psycho.Middleware{
+		Server: func(server psycho.ServerV2) psycho.ServerV2 {
+			return logServer{server, logger}
+		},
+		Handler: func(next psycho.DeliverFunc) psycho.DeliverFunc {
+			return func(pattern, queue string, msg *psycho.Msg) {
+				logger.Printf("MSG %s %d bytes", msg.Subject, len(msg.Payload))
+				next(pattern, queue, msg)
+			}
+		},
+	}
+}
+
+type logServer struct {
+	psycho.ServerV2
+	logger *log.Logger
+}
+
+func (s logServer) Pub(ctx context.Context, subj, reply string, header psycho.Header, payload []byte) error {
+	err := s.ServerV2.Pub(ctx, subj, reply, header, payload)
+	s.log(err, "PUB %s %d bytes", subj, len(payload))
+	return err
+}
+
+func (s logServer) Sub(ctx context.Context, subj, queue string) error {
+	err := s.ServerV2.Sub(ctx, subj, queue)
+	s.log(err, "SUB %s", withQueue(subj, queue))
+	return err
+}
+
+func (s logServer) Unsub(ctx context.Context, subj, queue string) error {
+	err := s.ServerV2.Unsub(ctx, subj, queue)
+	s.log(err, "UNSUB %s", withQueue(subj, queue))
+	return err
+}
+
+// withQueue returns subj, followed by queue if there's one.
+func withQueue(subj, queue string) string {
+	if queue == "" {
+		return subj
+	}
+	return subj + " " + queue
+}
+
+// log logs an op, followed by the error it failed with, if any.
+func (s logServer) log(err error, format string, args ...interface{}) {
+	if err != nil {
+		format += ": %v"
+		args = append(args, err)
+	}
+	s.logger.Printf(format, args...)
+}
+
+// Filter keeps messages on subjects that match any of the patterns in deny
+// from passing: publishing to such a subject, or subscribing to one of them
+// or one of the patterns, fails with psycho.ErrPermissionDenied, and the
+// handler doesn't get messages on them that a wildcard subscription matched.
+func Filter(deny ...string) psycho.Middleware {
+	f := filter(deny)
+	return psycho.Middleware{
+		Server: func(server psycho.ServerV2) psycho.ServerV2 {
+			return filterServer{server, f}
+		},
+		Handler: func(next psycho.DeliverFunc) psycho.DeliverFunc {
+			return func(pattern, queue string, msg *psycho.Msg) {
+				if !f.denies(msg.Subject) {
+					next(pattern, queue, msg)
+				}
+			}
+		},
+	}
+}
+
+type filter []string
+
+// denies reports whether subj is denied, or pattern is one of those that
+// deny.
+func (f filter) denies(subj string) bool {
+	for _, pattern := range f {
+		if pattern == subj || subject.IsLiteral(subj) && subject.Match(pattern, subj) {
+			return true
+		}
+	}
+	return false
+}
+
+type filterServer struct {
+	psycho.ServerV2
+	filter filter
+}
+
+func (s filterServer) Pub(ctx context.Context, subj, reply string, header psycho.Header, payload []byte) error {
+	if s.filter.denies(subj) {
+		return psycho.ErrPermissionDenied{Reason: "publish to " + subj}
+	}
+	return s.ServerV2.Pub(ctx, subj, reply, header, payload)
+}
+
+func (s filterServer) Sub(ctx context.Context, subj, queue string) error {
+	if s.filter.denies(subj) {
+		return psycho.ErrPermissionDenied{Reason: "subscribe to " + subj}
+	}
+	return s.ServerV2.Sub(ctx, subj, queue)
+}
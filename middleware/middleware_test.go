@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/servers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// msgs is a handler that passes on the messages it receives.
+type msgs chan *psycho.Msg
+
+func (h msgs) HandleInfo(map[string]interface{}) {}
+func (h msgs) HandleMsg(subj string, payload []byte) {
+	h <- &psycho.Msg{Subject: subj, Payload: payload}
+}
+func (h msgs) HandleHeaderMsg(subj, reply string, header psycho.Header, payload []byte) {
+	h <- &psycho.Msg{Subject: subj, Reply: reply, Header: header, Payload: payload}
+}
+
+// expect returns the next message h receives.
+func (h msgs) expect(t *testing.T) *psycho.Msg {
+	t.Helper()
+	select {
+	case msg := <-h:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+// expectNone checks that h receives no message for a while.
+func (h msgs) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-h:
+		t.Fatalf("unexpected message on %s", msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// serve serves server to a handler.
+func serve(t *testing.T, server psycho.ServerV2) msgs {
+	h := make(msgs, 10)
+	go server.ServeServerOpsTo(h)
+	t.Cleanup(func() { server.Close() })
+	return h
+}
+
+// pair returns a server wrapped in middlewares and another on the same hub,
+// both served.
+func pair(t *testing.T, middlewares ...psycho.Middleware) (psycho.ServerV2, msgs, psycho.ServerV2, msgs) {
+	hub := servers.NewMemoryHub(servers.MemoryConfig{})
+	a := psycho.Chain(hub.Attach().V2(), middlewares...)
+	b := hub.Attach().V2()
+	return a, serve(t, a), b, serve(t, b)
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	a, aMsgs, b, _ := pair(t, Logging(log.New(&buf, "", 0)))
+	ctx := context.Background()
+
+	require.NoError(t, a.Sub(ctx, "foo", ""))
+	require.NoError(t, b.Pub(ctx, "foo", "", nil, []byte("hi")))
+	aMsgs.expect(t)
+	require.NoError(t, a.Close())
+	assert.Error(t, a.Pub(ctx, "foo", "", nil, []byte("hi")))
+	assert.Equal(t, "SUB foo\nMSG foo 2 bytes\nPUB foo 2 bytes: psycho: using a closed server\n", buf.String())
+}
+
+func TestFilter(t *testing.T) {
+	a, aMsgs, b, bMsgs := pair(t, Filter("secret.>", "private"))
+	ctx := context.Background()
+
+	require.NoError(t, b.Sub(ctx, ">", ""))
+	assert.IsType(t, psycho.ErrPermissionDenied{}, a.Pub(ctx, "private", "", nil, nil))
+	assert.IsType(t, psycho.ErrPermissionDenied{}, a.Pub(ctx, "secret.foo", "", nil, nil))
+	require.NoError(t, a.Pub(ctx, "public", "", nil, nil))
+	assert.Equal(t, "public", bMsgs.expect(t).Subject)
+	bMsgs.expectNone(t)
+
+	assert.IsType(t, psycho.ErrPermissionDenied{}, a.Sub(ctx, "secret.foo", ""))
+	assert.IsType(t, psycho.ErrPermissionDenied{}, a.Sub(ctx, "secret.>", ""))
+	// Wildcards that match denied subjects are allowed, but don't get them.
+	require.NoError(t, a.Sub(ctx, "*", ""))
+	require.NoError(t, b.Pub(ctx, "private", "", nil, nil))
+	require.NoError(t, b.Pub(ctx, "public", "", nil, nil))
+	assert.Equal(t, "public", aMsgs.expect(t).Subject)
+	aMsgs.expectNone(t)
+}
+
+func TestGzip(t *testing.T) {
+	a, aMsgs, b, bMsgs := pair(t, Gzip())
+	ctx := context.Background()
+	payload := bytes.Repeat([]byte("hi"), 100)
+
+	require.NoError(t, a.Sub(ctx, "foo", ""))
+	require.NoError(t, b.Sub(ctx, "foo", ""))
+	require.NoError(t, a.Pub(ctx, "foo", "", nil, payload))
+	compressed := bMsgs.expect(t).Payload
+	assert.Less(t, len(compressed), len(payload))
+
+	require.NoError(t, b.Pub(ctx, "foo", "", nil, compressed))
+	assert.Equal(t, payload, aMsgs.expect(t).Payload)
+	// Messages that don't decompress are dropped.
+	require.NoError(t, b.Pub(ctx, "foo", "", nil, payload))
+	aMsgs.expectNone(t)
+}
+
+func TestGzipBomb(t *testing.T) {
+	a, aMsgs, b, _ := pair(t, Gzip())
+	ctx := context.Background()
+	// It compresses to about a thousandth of the size.
+	bomb, err := compress(make([]byte, psycho.DefaultMaxPayload+1))
+	require.NoError(t, err)
+	_, err = decompress(bomb, psycho.DefaultMaxPayload)
+	assert.IsType(t, psycho.ErrPayloadTooLarge{}, err)
+
+	require.NoError(t, a.Sub(ctx, "foo", ""))
+	require.NoError(t, b.Pub(ctx, "foo", "", nil, bomb))
+	aMsgs.expectNone(t)
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	a, aMsgs, b, _ := pair(t, metrics.Middleware())
+	ctx := context.Background()
+
+	require.NoError(t, a.Sub(ctx, "foo", ""))
+	require.NoError(t, a.Pub(ctx, "bar", "", nil, []byte("hi")))
+	require.NoError(t, a.Pub(ctx, "bar", "", nil, []byte("hello")))
+	require.NoError(t, b.Pub(ctx, "foo", "", nil, []byte("hi")))
+	aMsgs.expect(t)
+	assert.Equal(t, map[string]SubjectMetrics{
+		"bar": {Published: 2, PublishedBytes: 7},
+		"foo": {Delivered: 1, DeliveredBytes: 2},
+	}, metrics.Subjects())
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+
+	"github.com/Gaboose/psycho"
+)
+
+// Transform passes the payloads of published messages through out, and
+// those of delivered messages through in, which should undo out. Publishing
+// fails with the error out returns, and messages in fails on are dropped.
+func Transform(out, in func([]byte) ([]byte, error)) psycho.Middleware {
+	return psycho.Middleware{
+		Server: func(server psycho.ServerV2) psycho.ServerV2 {
+			return transformServer{server, out}
+		},
+		Handler: func(next psycho.DeliverFunc) psycho.DeliverFunc {
+			return func(pattern, queue string, msg *psycho.Msg) {
+				payload, err := in(msg.Payload)
+				if err != nil {
+					log.Printf("dropping message on subject %v: %v", msg.Subject, err)
+					return
+				}
+				transformed := *msg
+				transformed.Payload = payload
+				next(pattern, queue, &transformed)
+			}
+		},
+	}
+}
+
+type transformServer struct {
+	psycho.ServerV2
+	out func([]byte) ([]byte, error)
+}
+
+func (s transformServer) Pub(ctx context.Context, subj, reply string, header psycho.Header, payload []byte) error {
+	payload, err := s.out(payload)
+	if err != nil {
+		return err
+	}
+	return s.ServerV2.Pub(ctx, subj, reply, header, payload)
+}
+
+// Gzip compresses payloads with gzip on their way to the server, and
+// decompresses them on the way back. Every client on the network has to use
+// it. Messages that decompress to more than the server's max_payload are
+// dropped.
+func Gzip() psycho.Middleware {
+	maxPayload := int64(psycho.DefaultMaxPayload)
+	m := Transform(compress, func(payload []byte) ([]byte, error) {
+		return decompress(payload, atomic.LoadInt64(&maxPayload))
+	})
+	m.Info = func(info map[string]interface{}) {
+		if n, ok := info["max_payload"].(int); ok {
+			atomic.StoreInt64(&maxPayload, int64(n))
+		}
+	}
+	return m
+}
+
+func compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses payload, unless it takes more than max bytes.
+func decompress(payload []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decompressed)) > max {
+		return nil, psycho.ErrPayloadTooLarge{
+			Reason: fmt.Sprintf("payload decompresses to over %d bytes", max),
+		}
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,69 @@
+package psycho
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordServer records the subjects of the messages published through it.
+type recordServer struct {
+	ServerV2
+	name string
+	log  *[]string
+}
+
+func (s recordServer) Pub(ctx context.Context, subj, reply string, header Header, payload []byte) error {
+	*s.log = append(*s.log, s.name+" PUB "+subj)
+	return s.ServerV2.Pub(ctx, subj, reply, header, payload)
+}
+
+// record returns a middleware that records ops and messages to log.
+func record(name string, log *[]string) Middleware {
+	return Middleware{
+		Server: func(server ServerV2) ServerV2 {
+			return recordServer{server, name, log}
+		},
+		Handler: func(next DeliverFunc) DeliverFunc {
+			return func(pattern, queue string, msg *Msg) {
+				*log = append(*log, name+" MSG "+msg.Subject)
+				next(pattern, queue, msg)
+			}
+		},
+		Info: func(map[string]interface{}) {
+			*log = append(*log, name+" INFO")
+		},
+	}
+}
+
+// subHandler passes on the patterns of the subscriptions it receives
+// messages for, and "INFO" for the INFO.
+type subHandler chan string
+
+func (h subHandler) HandleInfo(map[string]interface{})              { h <- "INFO" }
+func (h subHandler) HandleMsg(string, []byte)                       { h <- "" }
+func (h subHandler) HandleHeaderMsg(string, string, Header, []byte) { h <- "" }
+func (h subHandler) HandleSubMsg(pattern, queue, subj, reply string, header Header, payload []byte) {
+	h <- pattern
+}
+
+func TestChain(t *testing.T) {
+	var log []string
+	fake := &fakeServer{perSub: true}
+	server := Chain(AdaptServer(fake), record("a", &log), record("b", &log))
+	ctx := context.Background()
+
+	h := make(subHandler, 1)
+	go server.ServeServerOpsTo(h)
+	defer server.Close()
+	require.Equal(t, "INFO", <-h)
+	require.NoError(t, server.Sub(ctx, "foo.*", ""))
+
+	// Ops pass through the middlewares in order, messages in reverse, and
+	// the handler still learns which subscription a message is for.
+	require.NoError(t, server.Pub(ctx, "foo.bar", "", nil, []byte("hi")))
+	assert.Equal(t, "foo.*", <-h)
+	assert.Equal(t, []string{"b INFO", "a INFO", "a PUB foo.bar", "b PUB foo.bar", "b MSG foo.bar", "a MSG foo.bar"}, log)
+}
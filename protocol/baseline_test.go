@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The baseline decoders are the text decoders the project started with,
+// copied verbatim apart from their names. They only know the original ops,
+// "PUB <subject> <#bytes>" and "MSG <subject> <#bytes>" among them, so the
+// benchmarks compare against them on those.
+
+type baselineClientOperation struct {
+	Type    ClientOpType
+	Subject string
+	Payload []byte
+	Error   error
+}
+
+type baselineServerDecoder struct {
+	reader *bufio.Reader
+}
+
+func newBaselineServerDecoder(r io.Reader) *baselineServerDecoder {
+	return &baselineServerDecoder{
+		reader: bufio.NewReader(r),
+	}
+}
+
+func (p *baselineServerDecoder) ReadOperation() (baselineClientOperation, bool) {
+	line, err := p.reader.ReadString('\n')
+	if err == io.EOF {
+		return baselineClientOperation{Error: io.EOF}, false
+	} else if err != nil {
+		return baselineClientOperation{Error: ErrParser{"reading new line"}}, false
+	}
+	tokens := strings.Split(line[:len(line)-1], " ")
+
+	if len(tokens) < 2 {
+		return baselineClientOperation{Error: ErrParser{
+			fmt.Sprintf("expected 2 or more tokens, found %d", len(tokens)),
+		}}, false
+	}
+
+	switch tokens[0] {
+	case "SUB":
+		if len(tokens) != 2 {
+			return baselineClientOperation{Error: ErrParser{
+				fmt.Sprintf("SUB op expects exactly 1 argument, found %d", len(tokens)-1),
+			}}, false
+		}
+		return baselineClientOperation{
+			Type:    TypeSubscribe,
+			Subject: tokens[1],
+		}, true
+	case "UNSUB":
+		if len(tokens) != 2 {
+			return baselineClientOperation{Error: ErrParser{
+				fmt.Sprintf("UNSUB op expects exactly 1 argument, found %d", len(tokens)-1),
+			}}, false
+		}
+		return baselineClientOperation{
+			Type:    TypeUnsubscribe,
+			Subject: tokens[1],
+		}, true
+	case "PUB":
+		if len(tokens) != 3 {
+			return baselineClientOperation{Error: ErrParser{
+				fmt.Sprintf("PUB op expects exactly 2 arguments, found %d", len(tokens)-1),
+			}}, false
+		}
+		payload, err := baselineReadPayload(p.reader, tokens[2])
+		if err != nil {
+			return baselineClientOperation{Error: ErrParser{fmt.Sprintf("reading payload: %v", err)}}, false
+		}
+		return baselineClientOperation{
+			Type:    TypePublish,
+			Subject: tokens[1],
+			Payload: payload,
+		}, true
+	default:
+		return baselineClientOperation{Error: ErrParser{"unknown op name"}}, false
+	}
+}
+
+type baselineServerOperation struct {
+	Type    ServerOpType
+	Subject string
+	Payload []byte
+	Map     map[string]string
+}
+
+type baselineClientDecoder struct {
+	reader *bufio.Reader
+}
+
+func newBaselineClientDecoder(r io.Reader) *baselineClientDecoder {
+	return &baselineClientDecoder{
+		reader: bufio.NewReader(r),
+	}
+}
+
+func (d *baselineClientDecoder) ReadOperation() (baselineServerOperation, error) {
+	line, err := d.reader.ReadString('\n')
+	if err != nil {
+		return baselineServerOperation{}, err
+	}
+	tokens := strings.Split(line[:len(line)-1], " ")
+
+	if len(tokens) < 1 {
+		return baselineServerOperation{}, errors.New("len(tokens) < 1")
+	}
+
+	switch tokens[0] {
+	case "INFO":
+		if len(tokens) != 2 {
+			return baselineServerOperation{}, errors.New("INFO len(tokens) != 2")
+		}
+		m := map[string]json.Number{}
+		if err := json.Unmarshal([]byte(tokens[1]), &m); err != nil {
+			return baselineServerOperation{}, err
+		}
+		op := baselineServerOperation{
+			Type:    TypeInfo,
+			Payload: []byte(tokens[1]),
+			Map:     map[string]string{},
+		}
+		for k, v := range m {
+			op.Map[k] = string(v)
+		}
+		return op, nil
+	case "MSG":
+		if len(tokens) != 3 {
+			return baselineServerOperation{}, errors.New("MSG len(tokens) != 3")
+		}
+		payload, err := baselineReadPayload(d.reader, tokens[2])
+		if err != nil {
+			return baselineServerOperation{}, ErrParser{}
+		}
+		return baselineServerOperation{
+			Type:    TypeMessage,
+			Subject: tokens[1],
+			Payload: payload,
+		}, nil
+	case "+OK":
+		return baselineServerOperation{
+			Type: TypeOK,
+		}, nil
+	case "-ERR":
+		if len(tokens) != 2 {
+			return baselineServerOperation{}, errors.New("ERR len(tokens) != 2")
+		}
+		return baselineServerOperation{
+			Type:    TypeError,
+			Payload: []byte(strings.Trim(tokens[1], "'")),
+		}, nil
+	}
+	return baselineServerOperation{}, ErrParser{}
+}
+
+func baselineReadPayload(reader *bufio.Reader, nbytes string) ([]byte, error) {
+	n, err := strconv.ParseUint(nbytes, 10, 64)
+	if err != nil {
+		return nil, errors.New("parsing number of bytes")
+	}
+	var payload = make([]byte, n)
+	nread, err := reader.Read(payload)
+	if nread < int(n) {
+		return nil, fmt.Errorf("expected to read %d bytes, but only read %d", n, nread)
+	}
+	if err != nil {
+		return nil, err
+	}
+	delim, err := reader.ReadString('\n')
+	if !(delim == "\n" || delim == "\r\n") {
+		return nil, fmt.Errorf("payload did not end with a new line")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,317 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Gaboose/psycho/subject"
+)
+
+// Encodings a connection can use after CONNECT. A server lists the ones it
+// supports in the "encodings" array of INFO, and a client picks one in the
+// encoding field of CONNECT. INFO and CONNECT themselves are always text.
+const (
+	EncodingText   = "text"
+	EncodingBinary = "binary"
+)
+
+// Encodings is what servers that use this package put in INFO.
+var Encodings = []string{EncodingText, EncodingBinary}
+
+// A binary frame is an op byte, the length of the body as a uvarint and the
+// body. Op bytes have the high bit set, which no text op starts with, so
+// decoders tell the two encodings apart op by op and peers may switch at any
+// time without a handshake.
+//
+// Strings and byte slices in a body are prefixed with their length as a
+// uvarint. Headers are a uvarint count of key-value pairs followed by the
+// pairs as strings.
+const (
+	frameConnect byte = 0x80 + iota
+	framePub
+	frameSub
+	frameUnsub
+	framePing
+	framePong
+	frameInfo
+	frameMsg
+	frameOK
+	frameErr
+)
+
+// maxFrameOverhead is how much larger than max_payload a frame may be, to
+// leave room for subjects and lengths.
+const maxFrameOverhead = 4096
+
+func isFrame(b byte) bool {
+	return b&0x80 != 0
+}
+
+// peekFrame reports whether the next op is a binary frame.
+func (d *decoder) peekFrame() (bool, error) {
+	b, err := d.reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return isFrame(b[0]), nil
+}
+
+// readFrame reads a frame's op byte and body. A frame too large for the
+// payload limit fails with ErrPayloadTooLarge, without its body being read.
+func (d *decoder) readFrame() (byte, *frameReader, error) {
+	op, err := d.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		return 0, nil, unexpected(err)
+	}
+	max := d.MaxPayload()
+	if n > uint64(max)+maxFrameOverhead {
+		return 0, nil, ErrPayloadTooLarge{fmt.Sprintf("%d byte frame exceeds the maximum of %d", n, max+maxFrameOverhead)}
+	}
+	body := d.alloc(int(n))
+	if _, err := io.ReadFull(d.reader, body); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	return op, &frameReader{b: body}, nil
+}
+
+// checkSize returns ErrPayloadTooLarge if a message decoded from a frame
+// exceeds the payload limit.
+func (d *decoder) checkSize(header Header, payload []byte) error {
+	if n, max := PayloadSize(header, payload), d.MaxPayload(); n > max {
+		return ErrPayloadTooLarge{fmt.Sprintf("%d bytes exceeds the maximum of %d", n, max)}
+	}
+	return nil
+}
+
+func (d *ServerDecoder) readFrame() (ClientOperation, error) {
+	code, f, err := d.decoder.readFrame()
+	if err != nil {
+		return ClientOperation{}, err
+	}
+	var op ClientOperation
+	switch code {
+	case frameConnect:
+		opts, err := parseConnect(f.bytes())
+		if err != nil {
+			return ClientOperation{}, err
+		}
+		op = ClientOperation{Type: TypeConnect, Connect: opts}
+	case framePing:
+		op = ClientOperation{Type: TypePing}
+	case framePong:
+		op = ClientOperation{Type: TypePong}
+	case frameSub, frameUnsub:
+		op = ClientOperation{Type: TypeSubscribe, Subject: f.str(), SID: f.uvarint(), Queue: f.str()}
+		if code == frameUnsub {
+			op.Type = TypeUnsubscribe
+		}
+	case framePub:
+		op = ClientOperation{Type: TypePublish, Subject: f.str(), Reply: f.str(), Header: f.header(), Payload: f.bytes()}
+	default:
+		return ClientOperation{}, ErrParser{fmt.Sprintf("unknown frame 0x%x", code)}
+	}
+	if err := f.done(); err != nil {
+		return ClientOperation{}, err
+	}
+
+	switch op.Type {
+	case TypeSubscribe, TypeUnsubscribe:
+		if !subject.ValidPattern(op.Subject) {
+			return ClientOperation{}, ErrParser{fmt.Sprintf("invalid subject %q", op.Subject)}
+		}
+		if op.Queue != "" && !subject.ValidSubject(op.Queue) {
+			return ClientOperation{}, ErrParser{fmt.Sprintf("invalid queue group %q", op.Queue)}
+		}
+		if op.Queue != "" && op.SID == 0 {
+			return ClientOperation{}, ErrParser{"queue group without a sid"}
+		}
+	case TypePublish:
+		if err := d.checkSize(op.Header, op.Payload); err != nil {
+			return ClientOperation{}, err
+		}
+		if err := validLiterals(op.Subject, op.Reply); err != nil {
+			return ClientOperation{}, err
+		}
+	}
+	return op, nil
+}
+
+func (d *ClientDecoder) readFrame() (ServerOperation, error) {
+	code, f, err := d.decoder.readFrame()
+	if err != nil {
+		return ServerOperation{}, err
+	}
+	var op ServerOperation
+	switch code {
+	case frameInfo:
+		if op, err = parseInfo(f.bytes()); err != nil {
+			return ServerOperation{}, err
+		}
+	case frameMsg:
+		op = ServerOperation{Type: TypeMessage, Subject: f.str(), SID: f.uvarint(), Reply: f.str(), Header: f.header(), Payload: f.bytes()}
+	case frameOK:
+		op = ServerOperation{Type: TypeOK}
+	case frameErr:
+		code, message := ErrorCode(f.str()), f.str()
+		if !validCode(code) {
+			return ServerOperation{}, ErrParser{fmt.Sprintf("invalid error code %q", code)}
+		}
+		op = ServerOperation{Type: TypeError, Code: code, Payload: []byte(message), Err: errorOf(code, message)}
+	case framePing:
+		op = ServerOperation{Type: TypeServerPing}
+	case framePong:
+		op = ServerOperation{Type: TypeServerPong}
+	default:
+		return ServerOperation{}, ErrParser{fmt.Sprintf("unknown frame 0x%x", code)}
+	}
+	if err := f.done(); err != nil {
+		return ServerOperation{}, err
+	}
+
+	if op.Type == TypeMessage {
+		if op.Reply != "" && op.SID == 0 {
+			return ServerOperation{}, ErrParser{"reply subject without a sid"}
+		}
+		if err := d.checkSize(op.Header, op.Payload); err != nil {
+			return ServerOperation{}, err
+		}
+		if err := validLiterals(op.Subject, op.Reply); err != nil {
+			return ServerOperation{}, err
+		}
+	}
+	return op, nil
+}
+
+// frameReader reads the fields of a frame body. The first malformed field
+// fails it, and done reports the failure.
+type frameReader struct {
+	b   []byte
+	err error
+}
+
+func (f *frameReader) uvarint() uint64 {
+	if f.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(f.b)
+	if n <= 0 {
+		f.err = ErrParser{"malformed frame"}
+		return 0
+	}
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *frameReader) bytes() []byte {
+	n := f.uvarint()
+	if f.err != nil {
+		return nil
+	}
+	if n > uint64(len(f.b)) {
+		f.err = ErrParser{"malformed frame"}
+		return nil
+	}
+	v := f.b[:n:n]
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *frameReader) str() string {
+	return string(f.bytes())
+}
+
+func (f *frameReader) header() Header {
+	n := f.uvarint()
+	if n == 0 || f.err != nil {
+		return nil
+	}
+	if n > uint64(len(f.b)) {
+		f.err = ErrParser{"malformed frame"}
+		return nil
+	}
+	h := Header{}
+	for i := uint64(0); i < n && f.err == nil; i++ {
+		// Values lose their leading spaces like they do in text, so that
+		// headers come out the same in either encoding.
+		h.Add(f.str(), strings.TrimLeft(f.str(), " "))
+	}
+	if err := h.Validate(); err != nil && f.err == nil {
+		f.err = err
+	}
+	return h
+}
+
+func (f *frameReader) done() error {
+	if f.err == nil && len(f.b) > 0 {
+		return ErrParser{"malformed frame"}
+	}
+	return f.err
+}
+
+// frameWriter builds a frame body.
+type frameWriter struct {
+	b []byte
+}
+
+func (f *frameWriter) uvarint(v uint64) *frameWriter {
+	var buf [binary.MaxVarintLen64]byte
+	f.b = append(f.b, buf[:binary.PutUvarint(buf[:], v)]...)
+	return f
+}
+
+func (f *frameWriter) bytes(v []byte) *frameWriter {
+	f.uvarint(uint64(len(v)))
+	f.b = append(f.b, v...)
+	return f
+}
+
+func (f *frameWriter) str(v string) *frameWriter {
+	f.uvarint(uint64(len(v)))
+	f.b = append(f.b, v...)
+	return f
+}
+
+func (f *frameWriter) header(h Header) *frameWriter {
+	keys := make([]string, 0, len(h))
+	var n int
+	for k, vs := range h {
+		keys = append(keys, k)
+		n += len(vs)
+	}
+	sort.Strings(keys)
+	f.uvarint(uint64(n))
+	for _, k := range keys {
+		for _, v := range h[k] {
+			f.str(k).str(v)
+		}
+	}
+	return f
+}
+
+// frame returns the complete frame with op and the body written so far.
+func (f *frameWriter) frame(op byte) []byte {
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = op
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(f.b)))
+	return append(buf[:n:n], f.b...)
+}
+
+func emptyFrame(op byte) []byte {
+	return (&frameWriter{}).frame(op)
+}
+
+func jsonFrame(op byte, v interface{}) ([]byte, error) {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return (&frameWriter{}).bytes(bts).frame(op), nil
+}
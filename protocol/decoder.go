@@ -0,0 +1,515 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+
+	"github.com/Gaboose/psycho/subject"
+)
+
+// maxLineLength bounds op lines, CONNECT and INFO included, so that a peer
+// can't make a decoder buffer a line that never ends.
+const maxLineLength = 32 << 10
+
+// maxStrings bounds the subjects a decoder that reuses buffers keeps the
+// strings of.
+const maxStrings = 256
+
+// maxArgs is more arguments than any op takes. Op lines are split into
+// slices of a fixed array this long, so that parsing them doesn't allocate.
+const maxArgs = 6
+
+// decoder holds what ServerDecoder and ClientDecoder share: reading op lines
+// and the payloads that follow them.
+type decoder struct {
+	reader     *bufio.Reader
+	maxPayload int64
+	args       [maxArgs][]byte
+	// reuse and buf are set by SetReuseBuffers, and interned is kept if
+	// reuse is.
+	reuse    bool
+	buf      []byte
+	interned map[string]string
+}
+
+func newDecoder(r io.Reader) decoder {
+	return decoder{
+		reader:     bufio.NewReaderSize(r, maxLineLength),
+		maxPayload: DefaultMaxPayload,
+	}
+}
+
+// SetMaxPayload sets the largest payload, headers included, the decoder
+// accepts. Larger payloads are reported with ErrPayloadTooLarge without being
+// read, after which the decoder can't go on. It's safe to call while another
+// goroutine reads.
+func (d *decoder) SetMaxPayload(n int) {
+	atomic.StoreInt64(&d.maxPayload, int64(n))
+}
+
+func (d *decoder) MaxPayload() int {
+	return int(atomic.LoadInt64(&d.maxPayload))
+}
+
+// SetReuseBuffers makes the decoder read payloads into a buffer it reuses
+// instead of allocating one per op. Payloads are then only valid until the
+// next ReadOperation, so callers must copy those they keep. Unlike
+// SetMaxPayload, it must not be called while another goroutine reads.
+func (d *decoder) SetReuseBuffers(reuse bool) {
+	d.reuse, d.buf, d.interned = reuse, nil, nil
+	if reuse {
+		d.interned = map[string]string{}
+	}
+}
+
+// Reset discards whatever the decoder has buffered and makes it read from r,
+// keeping its buffers and settings. It lets callers that decode many short
+// inputs, such as datagrams, use one decoder for all of them.
+func (d *decoder) Reset(r io.Reader) {
+	d.reader.Reset(r)
+}
+
+// alloc returns a buffer for n bytes of payload. Reused buffers are never
+// nil, so that empty payloads are reported the same either way.
+func (d *decoder) alloc(n int) []byte {
+	if !d.reuse {
+		return make([]byte, n)
+	}
+	if d.buf == nil || cap(d.buf) < n {
+		d.buf = make([]byte, n, n+512)
+	}
+	return d.buf[:n]
+}
+
+// subjects converts the subject and reply subject fields of rest to strings.
+// A decoder that reuses buffers reuses the strings of the last maxStrings
+// subjects too, so that messages on a subject seen before don't allocate.
+// Otherwise both are converted with one allocation.
+func (d *decoder) subjects(rest, subj, reply []byte) (string, string) {
+	if !d.reuse {
+		return stringPair(rest, subj, reply)
+	}
+	return d.string(subj), d.string(reply)
+}
+
+// subject is like subjects, for a message without a reply subject.
+func (d *decoder) subject(subj []byte) string {
+	if !d.reuse {
+		return string(subj)
+	}
+	return d.string(subj)
+}
+
+func (d *decoder) string(b []byte) string {
+	// Looking up a converted byte slice doesn't allocate.
+	if s, ok := d.interned[string(b)]; ok {
+		return s
+	}
+	if len(d.interned) >= maxStrings {
+		for k := range d.interned {
+			delete(d.interned, k)
+		}
+	}
+	s := string(b)
+	d.interned[s] = s
+	return s
+}
+
+// readLine reads an op line, which may end with "\r\n" as well as "\n", and
+// splits it into the op name and the rest of the line. Both point into the
+// reader's buffer and are only valid until the next read.
+func (d *decoder) readLine() (name, rest []byte, err error) {
+	line, err := d.reader.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return nil, nil, ErrParser{fmt.Sprintf("op line longer than %d bytes", maxLineLength)}
+	case err == io.EOF && len(line) > 0:
+		return nil, nil, io.ErrUnexpectedEOF
+	case err != nil:
+		return nil, nil, err
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	if len(line) == 0 {
+		return nil, nil, ErrParser{"empty line"}
+	}
+	i := 0
+	for i < len(line) && !isSpace(line[i]) {
+		i++
+	}
+	name, rest = line[:i], line[i:]
+	for len(rest) > 0 && isSpace(rest[0]) {
+		rest = rest[1:]
+	}
+	return name, rest, nil
+}
+
+// fields splits rest at whitespace into slices backed by d.args. It returns
+// the first maxArgs fields and how many there are in all.
+func (d *decoder) fields(rest []byte) ([][]byte, int) {
+	args, n := d.args[:0], 0
+	for i := 0; i < len(rest); {
+		for i < len(rest) && isSpace(rest[i]) {
+			i++
+		}
+		j := i
+		for j < len(rest) && !isSpace(rest[j]) {
+			j++
+		}
+		if j > i {
+			if n < maxArgs {
+				args = append(args, rest[i:j])
+			}
+			n++
+		}
+		i = j
+	}
+	return args, n
+}
+
+// isSpace reports whether b separates fields. It's the whitespace that
+// subjects can't contain.
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r'
+}
+
+// stringPair converts two fields of rest to strings with a single allocation,
+// by converting the stretch of rest from the start of a to the end of b.
+func stringPair(rest, a, b []byte) (string, string) {
+	// Fields share rest's backing array, so their offsets follow from their
+	// capacities.
+	start, end := cap(rest)-cap(a), cap(rest)-cap(b)+len(b)
+	s := string(rest[start:end])
+	return s[:len(a)], s[len(s)-len(b):]
+}
+
+// parseUint parses a decimal number like strconv.ParseUint does, but from a
+// byte slice, which strconv can't do without converting it to a string.
+func parseUint(b []byte) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		if n > (math.MaxUint64-uint64(c-'0'))/10 {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	return n, true
+}
+
+// readPayload reads a payload of nbytes bytes and the new line after it. A
+// payload larger than the limit isn't read at all, since skipping it could
+// keep the reader busy for as long as the peer cares to send, and
+// ErrPayloadTooLarge is returned instead.
+func (d *decoder) readPayload(nbytes []byte) ([]byte, error) {
+	n, ok := parseUint(nbytes)
+	if !ok {
+		return nil, ErrParser{fmt.Sprintf("invalid number of bytes %q", nbytes)}
+	}
+	if max := d.MaxPayload(); n > uint64(max) {
+		return nil, ErrPayloadTooLarge{fmt.Sprintf("%d bytes exceeds the maximum of %d", n, max)}
+	}
+	payload := d.alloc(int(n))
+	if _, err := io.ReadFull(d.reader, payload); err != nil {
+		return nil, unexpected(err)
+	}
+	if err := d.readDelim(); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readHeaderPayload reads the body of HPUB and HMSG ops: a header section of
+// hbytes bytes followed by the payload, tbytes bytes in total.
+func (d *decoder) readHeaderPayload(hbytes, tbytes []byte) (Header, []byte, error) {
+	n, ok := parseUint(hbytes)
+	if !ok {
+		return nil, nil, ErrParser{fmt.Sprintf("invalid number of header bytes %q", hbytes)}
+	}
+	body, err := d.readPayload(tbytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n < 1 || n > uint64(len(body)) {
+		return nil, nil, ErrParser{"invalid number of header bytes"}
+	}
+	h, err := decodeHeader(body[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, body[n:], nil
+}
+
+// readDelim reads the new line that ends a payload.
+func (d *decoder) readDelim() error {
+	b, err := d.reader.ReadByte()
+	if err == nil && b == '\r' {
+		b, err = d.reader.ReadByte()
+	}
+	if err != nil {
+		return unexpected(err)
+	}
+	if b != '\n' {
+		return ErrParser{"payload did not end with a new line"}
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ServerDecoder reads the ops a client sends.
+type ServerDecoder struct {
+	decoder
+}
+
+func NewServerDecoder(r io.Reader) *ServerDecoder {
+	return &ServerDecoder{newDecoder(r)}
+}
+
+// ReadOperation reads the next op, in either encoding. It returns io.EOF when
+// the client is gone without leaving an op unfinished. After an error for
+// which IsFatal is true the stream can't be trusted to be at an op boundary.
+func (d *ServerDecoder) ReadOperation() (ClientOperation, error) {
+	if frame, err := d.peekFrame(); err != nil {
+		return ClientOperation{}, err
+	} else if frame {
+		return d.readFrame()
+	}
+	name, rest, err := d.readLine()
+	if err != nil {
+		return ClientOperation{}, err
+	}
+
+	// Switching on the converted name doesn't allocate.
+	switch string(name) {
+	case "CONNECT":
+		opts, err := parseConnect(rest)
+		if err != nil {
+			return ClientOperation{}, err
+		}
+		return ClientOperation{Type: TypeConnect, Connect: opts}, nil
+	}
+
+	args, nargs := d.fields(rest)
+	switch string(name) {
+	case "PING", "PONG":
+		if nargs != 0 {
+			return ClientOperation{}, ErrParser{
+				fmt.Sprintf("%s op expects no arguments, found %d", name, nargs),
+			}
+		}
+		if string(name) == "PING" {
+			return ClientOperation{Type: TypePing}, nil
+		}
+		return ClientOperation{Type: TypePong}, nil
+	case "SUB", "UNSUB":
+		if nargs < 1 || nargs > 3 {
+			return ClientOperation{}, ErrParser{
+				fmt.Sprintf("%s op expects 1 to 3 arguments, found %d", name, nargs),
+			}
+		}
+		op := ClientOperation{Type: TypeSubscribe, Subject: string(args[0])}
+		if !subject.ValidPattern(op.Subject) {
+			return ClientOperation{}, ErrParser{fmt.Sprintf("invalid subject %q", op.Subject)}
+		}
+		if string(name) == "UNSUB" {
+			op.Type = TypeUnsubscribe
+		}
+		if nargs >= 2 {
+			if op.SID, err = parseSID(args[1]); err != nil {
+				return ClientOperation{}, err
+			}
+		}
+		if nargs == 3 {
+			op.Queue = string(args[2])
+			if !subject.ValidSubject(op.Queue) {
+				return ClientOperation{}, ErrParser{fmt.Sprintf("invalid queue group %q", op.Queue)}
+			}
+		}
+		return op, nil
+	case "PUB", "HPUB":
+		// HPUB takes one more argument, the number of header bytes.
+		want := 2
+		if string(name) == "HPUB" {
+			want = 3
+		}
+		if nargs != want && nargs != want+1 {
+			return ClientOperation{}, ErrParser{
+				fmt.Sprintf("%s op expects %d or %d arguments, found %d", name, want, want+1, nargs),
+			}
+		}
+		// The subjects are copied out of the line before reading the payload
+		// overwrites it, and checked after, so that a too large payload is
+		// reported even if they're invalid too.
+		op := ClientOperation{Type: TypePublish}
+		if nargs == want+1 {
+			op.Subject, op.Reply = d.subjects(rest, args[0], args[1])
+		} else {
+			op.Subject = d.subject(args[0])
+		}
+		if string(name) == "HPUB" {
+			op.Header, op.Payload, err = d.readHeaderPayload(args[nargs-2], args[nargs-1])
+		} else {
+			op.Payload, err = d.readPayload(args[nargs-1])
+		}
+		if err != nil {
+			return ClientOperation{}, err
+		}
+		if err := validLiterals(op.Subject, op.Reply); err != nil {
+			return ClientOperation{}, err
+		}
+		return op, nil
+	}
+	return ClientOperation{}, ErrParser{fmt.Sprintf("unknown op %q", name)}
+}
+
+// ClientDecoder reads the ops a server sends.
+type ClientDecoder struct {
+	decoder
+}
+
+func NewClientDecoder(r io.Reader) *ClientDecoder {
+	return &ClientDecoder{newDecoder(r)}
+}
+
+// ReadOperation reads the next op, in either encoding. Like with
+// ServerDecoder, only errors for which IsFatal is false leave the stream at an
+// op boundary.
+func (d *ClientDecoder) ReadOperation() (ServerOperation, error) {
+	if frame, err := d.peekFrame(); err != nil {
+		return ServerOperation{}, err
+	} else if frame {
+		return d.readFrame()
+	}
+	name, rest, err := d.readLine()
+	if err != nil {
+		return ServerOperation{}, err
+	}
+
+	switch string(name) {
+	case "INFO":
+		return parseInfo(rest)
+	case "-ERR":
+		if len(rest) == 0 {
+			return ServerOperation{}, ErrParser{"-ERR op expects an error"}
+		}
+		code, message := parseErr(string(rest))
+		return ServerOperation{
+			Type:    TypeError,
+			Code:    code,
+			Payload: []byte(message),
+			Err:     errorOf(code, message),
+		}, nil
+	}
+
+	args, nargs := d.fields(rest)
+	switch string(name) {
+	case "MSG", "HMSG":
+		// HMSG takes one more argument, the number of header bytes.
+		want := 2
+		if string(name) == "HMSG" {
+			want = 3
+		}
+		if nargs < want || nargs > want+2 {
+			return ServerOperation{}, ErrParser{
+				fmt.Sprintf("%s op expects %d to %d arguments, found %d", name, want, want+2, nargs),
+			}
+		}
+		op := ServerOperation{Type: TypeMessage}
+		if nargs >= want+1 {
+			if op.SID, err = parseSID(args[1]); err != nil {
+				return ServerOperation{}, err
+			}
+		}
+		if nargs == want+2 {
+			op.Subject, op.Reply = d.subjects(rest, args[0], args[2])
+		} else {
+			op.Subject = d.subject(args[0])
+		}
+		if string(name) == "HMSG" {
+			op.Header, op.Payload, err = d.readHeaderPayload(args[nargs-2], args[nargs-1])
+		} else {
+			op.Payload, err = d.readPayload(args[nargs-1])
+		}
+		if err != nil {
+			return ServerOperation{}, err
+		}
+		if err := validLiterals(op.Subject, op.Reply); err != nil {
+			return ServerOperation{}, err
+		}
+		return op, nil
+	case "PING", "PONG", "+OK":
+		if nargs != 0 {
+			return ServerOperation{}, ErrParser{
+				fmt.Sprintf("%s op expects no arguments, found %d", name, nargs),
+			}
+		}
+		switch string(name) {
+		case "PING":
+			return ServerOperation{Type: TypeServerPing}, nil
+		case "PONG":
+			return ServerOperation{Type: TypeServerPong}, nil
+		}
+		return ServerOperation{Type: TypeOK}, nil
+	}
+	return ServerOperation{}, ErrParser{fmt.Sprintf("unknown op %q", name)}
+}
+
+// parseInfo parses the JSON of INFO and copies it into the op's payload,
+// since arg points into a buffer the decoder reuses.
+func parseInfo(arg []byte) (ServerOperation, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(arg, &m); err != nil {
+		return ServerOperation{}, ErrParser{fmt.Sprintf("invalid INFO: %v", err)}
+	}
+	op := ServerOperation{
+		Type:    TypeInfo,
+		Payload: append([]byte(nil), arg...),
+		Map:     map[string]string{},
+	}
+	for k, v := range m {
+		var str string
+		if err := json.Unmarshal(v, &str); err != nil {
+			str = string(v)
+		}
+		op.Map[k] = str
+	}
+	return op, nil
+}
+
+// parseSID parses a SID, which is positive. Zero stands for no SID in
+// ClientOperation and ServerOperation, and in the binary encoding.
+func parseSID(token []byte) (uint64, error) {
+	sid, ok := parseUint(token)
+	if !ok || sid == 0 {
+		return 0, ErrParser{fmt.Sprintf("invalid sid %q", token)}
+	}
+	return sid, nil
+}
+
+// validLiterals checks the subject and optional reply subject of a message.
+func validLiterals(subj, reply string) error {
+	if !subject.ValidSubject(subj) {
+		return ErrParser{fmt.Sprintf("invalid subject %q", subj)}
+	}
+	if reply != "" && !subject.ValidSubject(reply) {
+		return ErrParser{fmt.Sprintf("invalid reply subject %q", reply)}
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The fuzz targets feed arbitrary input to the decoders, which must not panic
+// or allocate more than the payload limit allows. Every op that decodes must
+// decode the same with reused buffers and survive being encoded again, in
+// both encodings.
+
+func FuzzServerDecoder(f *testing.F) {
+	seed(f, "client")
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ops := readClientOps(in, false)
+		assert.Equal(t, ops, readClientOps(in, true))
+
+		for _, encoding := range Encodings {
+			var buf bytes.Buffer
+			enc := NewClientEncoder(&buf)
+			enc.SetEncoding(encoding)
+			var want []string
+			for _, op := range ops {
+				switch op.Type {
+				case TypeConnect:
+					enc.Connect(*op.Connect)
+				case TypePing:
+					enc.Ping()
+				case TypePong:
+					enc.Pong()
+				case TypeSubscribe:
+					enc.Subscribe(op.Subject, op.SID, op.Queue)
+				case TypeUnsubscribe:
+					enc.Unsubscribe(op.Subject, op.SID, op.Queue)
+				case TypePublish:
+					enc.Publish(op.Subject, op.Reply, op.Header, op.Payload)
+				default:
+					continue
+				}
+				want = append(want, op.dump)
+			}
+			var got []string
+			for _, op := range readClientOps(buf.Bytes(), false) {
+				got = append(got, op.dump)
+			}
+			require.Equal(t, want, got, encoding)
+		}
+	})
+}
+
+func FuzzClientDecoder(f *testing.F) {
+	seed(f, "server")
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ops := readServerOps(in, false)
+		assert.Equal(t, ops, readServerOps(in, true))
+
+		for _, encoding := range Encodings {
+			var buf bytes.Buffer
+			enc := NewServerEncoder(&buf)
+			enc.SetEncoding(encoding)
+			var want []string
+			for _, op := range ops {
+				// INFO is left out, since its values needn't come out of
+				// JSON the way they went in.
+				switch op.Type {
+				case TypeMessage:
+					enc.Msg(op.Subject, op.SID, op.Reply, op.Header, op.Payload)
+				case TypeServerPing:
+					enc.Ping()
+				case TypeServerPong:
+					enc.Pong()
+				case TypeOK:
+					enc.OK()
+				case TypeError:
+					enc.Err(op.Err)
+				default:
+					continue
+				}
+				want = append(want, op.dump)
+			}
+			var got []string
+			for _, op := range readServerOps(buf.Bytes(), false) {
+				got = append(got, op.dump)
+			}
+			require.Equal(t, want, got, encoding)
+		}
+	})
+}
+
+func seed(f *testing.F, dir string) {
+	for _, pattern := range []string{"*.txt", "*.bin"} {
+		files, err := filepath.Glob(filepath.Join("testdata", dir, pattern))
+		require.NoError(f, err)
+		for _, file := range files {
+			in, err := ioutil.ReadFile(file)
+			require.NoError(f, err)
+			f.Add(in)
+		}
+	}
+}
+
+// dumpedClientOp is an op along with its dump, taken before reading the next
+// op can overwrite a reused payload.
+type dumpedClientOp struct {
+	ClientOperation
+	dump string
+}
+
+type dumpedServerOp struct {
+	ServerOperation
+	dump string
+}
+
+func readClientOps(in []byte, reuse bool) []dumpedClientOp {
+	dec := NewServerDecoder(bytes.NewReader(in))
+	dec.SetMaxPayload(64)
+	dec.SetReuseBuffers(reuse)
+	var ops []dumpedClientOp
+	for {
+		op, err := dec.ReadOperation()
+		if err != nil {
+			if err == io.EOF || IsFatal(err) {
+				return ops
+			}
+			ops = append(ops, dumpedClientOp{dump: "error: " + err.Error()})
+			continue
+		}
+		if len(op.Header) == 0 {
+			op.Header = nil
+		}
+		dumped := dumpedClientOp{ClientOperation: op, dump: dumpClientOp(op)}
+		if op.Payload != nil {
+			dumped.Payload = append([]byte{}, op.Payload...)
+		}
+		ops = append(ops, dumped)
+	}
+}
+
+func readServerOps(in []byte, reuse bool) []dumpedServerOp {
+	dec := NewClientDecoder(bytes.NewReader(in))
+	dec.SetMaxPayload(64)
+	dec.SetReuseBuffers(reuse)
+	var ops []dumpedServerOp
+	for {
+		op, err := dec.ReadOperation()
+		if err != nil {
+			if err == io.EOF || IsFatal(err) {
+				return ops
+			}
+			ops = append(ops, dumpedServerOp{dump: "error: " + err.Error()})
+			continue
+		}
+		if len(op.Header) == 0 {
+			op.Header = nil
+		}
+		dumped := dumpedServerOp{ServerOperation: op, dump: dumpServerOp(op)}
+		if op.Type == TypeError {
+			// Errors with known codes are sent with their own message, so
+			// only the code and the error must survive encoding.
+			dumped.dump = dumpServerOp(ServerOperation{Type: op.Type, Code: op.Code, Err: op.Err})
+		}
+		if op.Payload != nil {
+			dumped.Payload = append([]byte{}, op.Payload...)
+		}
+		ops = append(ops, dumped)
+	}
+}
+
+func TestDecoderLineTooLong(t *testing.T) {
+	in := "PUB " + strings.Repeat("a", maxLineLength) + " 0\n\n"
+	_, err := NewServerDecoder(strings.NewReader(in)).ReadOperation()
+	assert.Equal(t, ErrParser{"op line longer than 32768 bytes"}, err)
+}
+
+// unread fails the test if it's read from.
+type unread struct{ t *testing.T }
+
+func (r unread) Read(b []byte) (int, error) {
+	r.t.Error("payload was read")
+	return 0, io.EOF
+}
+
+func TestDecoderPayloadTooLarge(t *testing.T) {
+	for _, op := range [][]byte{
+		[]byte("PUB foo 99999999999\n"),
+		append([]byte{framePub}, 0xff, 0xff, 0xff, 0xff, 0x7f),
+	} {
+		dec := NewServerDecoder(io.MultiReader(bytes.NewReader(op), unread{t}))
+		_, err := dec.ReadOperation()
+		assert.IsType(t, ErrPayloadTooLarge{}, err)
+		assert.True(t, IsFatal(err))
+	}
+}
+
+func TestDecoderReuseBuffers(t *testing.T) {
+	dec := NewClientDecoder(strings.NewReader("MSG foo 5\nhello\nMSG foo 3\nbye\n"))
+	dec.SetReuseBuffers(true)
+	first, err := dec.ReadOperation()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(first.Payload))
+	second, err := dec.ReadOperation()
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(second.Payload))
+	// Both point into the same buffer.
+	assert.Equal(t, "byelo", string(first.Payload))
+}
+
+func TestDecoderReuseBuffersDontAllocate(t *testing.T) {
+	input := []byte("PUB foo 5\nhello\nPUB bar baz 3\nbye\n")
+	r := bytes.NewReader(input)
+	dec := NewServerDecoder(r)
+	dec.SetReuseBuffers(true)
+
+	var ops []ClientOperation
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(input)
+		dec.Reset(r)
+		ops = ops[:0]
+		for i := 0; i < 2; i++ {
+			op, err := dec.ReadOperation()
+			require.NoError(t, err)
+			ops = append(ops, op)
+		}
+	})
+	assert.Zero(t, allocs)
+	assert.Equal(t, "foo", ops[0].Subject)
+	assert.Equal(t, "bar", ops[1].Subject)
+	assert.Equal(t, "baz", ops[1].Reply)
+	assert.Equal(t, "bye", string(ops[1].Payload))
+}
+
+// The benchmarks decode a stream of messages with the rewritten decoders, with
+// and without reused buffers, and with the original ones they replaced. The
+// messages carry no SID or reply subject, which the original decoders lack.
+
+var (
+	benchPub = bytes.Repeat([]byte("PUB foo.bar 16\n0123456789abcdef\n"), 1000)
+	benchMsg = bytes.Repeat([]byte("MSG foo.bar 16\n0123456789abcdef\n"), 1000)
+)
+
+func BenchmarkServerDecoder(b *testing.B) {
+	b.Run("baseline", func(b *testing.B) {
+		benchDecode(b, benchPub, func(r io.Reader) func() error {
+			dec := newBaselineServerDecoder(r)
+			return func() error { op, _ := dec.ReadOperation(); return op.Error }
+		})
+	})
+	for _, reuse := range []bool{false, true} {
+		reuse := reuse
+		b.Run(reuseName(reuse), func(b *testing.B) {
+			benchDecode(b, benchPub, func(r io.Reader) func() error {
+				dec := NewServerDecoder(r)
+				dec.SetReuseBuffers(reuse)
+				return func() error { _, err := dec.ReadOperation(); return err }
+			})
+		})
+	}
+}
+
+func BenchmarkClientDecoder(b *testing.B) {
+	b.Run("baseline", func(b *testing.B) {
+		benchDecode(b, benchMsg, func(r io.Reader) func() error {
+			dec := newBaselineClientDecoder(r)
+			return func() error { _, err := dec.ReadOperation(); return err }
+		})
+	})
+	for _, reuse := range []bool{false, true} {
+		reuse := reuse
+		b.Run(reuseName(reuse), func(b *testing.B) {
+			benchDecode(b, benchMsg, func(r io.Reader) func() error {
+				dec := NewClientDecoder(r)
+				dec.SetReuseBuffers(reuse)
+				return func() error { _, err := dec.ReadOperation(); return err }
+			})
+		})
+	}
+}
+
+func reuseName(reuse bool) string {
+	if reuse {
+		return "reuse"
+	}
+	return "alloc"
+}
+
+// benchDecode reads b.N ops from a decoder made by newDecoder, starting over
+// whenever it runs out of input.
+func benchDecode(b *testing.B, in []byte, newDecoder func(io.Reader) func() error) {
+	r := bytes.NewReader(in)
+	read := newDecoder(r)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in) / 1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := read()
+		if err == io.EOF {
+			r.Reset(in)
+			err = read()
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
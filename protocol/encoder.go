@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// encoder holds what ServerEncoder and ClientEncoder share. Every op is
+// written with a single Write, under a lock, so encoders can be used from
+// several goroutines.
+type encoder struct {
+	writer io.Writer
+	mu     sync.Mutex
+	binary int32
+}
+
+// SetEncoding switches to EncodingText or EncodingBinary for the ops that
+// follow. It's safe to call while another goroutine writes, since decoders
+// take either encoding at any time.
+func (e *encoder) SetEncoding(encoding string) error {
+	switch encoding {
+	case EncodingText, "":
+		atomic.StoreInt32(&e.binary, 0)
+	case EncodingBinary:
+		atomic.StoreInt32(&e.binary, 1)
+	default:
+		return fmt.Errorf("unknown encoding %q", encoding)
+	}
+	return nil
+}
+
+func (e *encoder) isBinary() bool {
+	return atomic.LoadInt32(&e.binary) == 1
+}
+
+func (e *encoder) write(p []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.writer.Write(p)
+	return err
+}
+
+func (e *encoder) Ping() error {
+	if e.isBinary() {
+		return e.write(emptyFrame(framePing))
+	}
+	return e.write([]byte("PING\n"))
+}
+
+func (e *encoder) Pong() error {
+	if e.isBinary() {
+		return e.write(emptyFrame(framePong))
+	}
+	return e.write([]byte("PONG\n"))
+}
+
+// ServerEncoder writes the ops a server sends.
+type ServerEncoder struct {
+	encoder
+}
+
+func NewServerEncoder(w io.Writer) *ServerEncoder {
+	return &ServerEncoder{encoder{writer: w}}
+}
+
+// Info sends INFO. The first one goes out before the client has picked an
+// encoding, so servers send it as text.
+func (e *ServerEncoder) Info(values map[string]interface{}) error {
+	if e.isBinary() {
+		frame, err := jsonFrame(frameInfo, values)
+		if err != nil {
+			return err
+		}
+		return e.write(frame)
+	}
+	bts, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return e.write([]byte(fmt.Sprintf("INFO %s\n", bts)))
+}
+
+// Msg delivers a message to the subscription identified by sid. A zero sid is
+// left out, for clients that subscribed without one, and so is the reply
+// subject then, since like in NATS only a SID may precede it. Messages with
+// headers are sent as HMSG.
+func (e *ServerEncoder) Msg(subject string, sid uint64, reply string, header Header, payload []byte) error {
+	if sid == 0 {
+		reply = ""
+	}
+	if e.isBinary() {
+		f := &frameWriter{b: make([]byte, 0, len(payload)+len(subject)+len(reply)+32)}
+		return e.write(f.str(subject).uvarint(sid).str(reply).header(header).bytes(payload).frame(frameMsg))
+	}
+	op, sizes, hdr := msgSizes("MSG", "HMSG", header, payload)
+	buf := bytes.NewBuffer(make([]byte, 0, len(hdr)+len(payload)+len(subject)+len(reply)+32))
+	switch {
+	case reply != "":
+		fmt.Fprintf(buf, "%s %s %d %s %s\n", op, subject, sid, reply, sizes)
+	case sid != 0:
+		fmt.Fprintf(buf, "%s %s %d %s\n", op, subject, sid, sizes)
+	default:
+		fmt.Fprintf(buf, "%s %s %s\n", op, subject, sizes)
+	}
+	buf.Write(hdr)
+	buf.Write(payload)
+	buf.WriteByte('\n')
+	return e.write(buf.Bytes())
+}
+
+func (e *ServerEncoder) OK() error {
+	if e.isBinary() {
+		return e.write(emptyFrame(frameOK))
+	}
+	return e.write([]byte("+OK\n"))
+}
+
+// Err sends err with the code of its type. See ErrorCode.
+func (e *ServerEncoder) Err(err error) error {
+	if e.isBinary() {
+		code, message := codeOf(err)
+		return e.write((&frameWriter{}).str(string(code)).str(message).frame(frameErr))
+	}
+	return e.write(encodeErr(err))
+}
+
+// ClientEncoder writes the ops a client sends.
+type ClientEncoder struct {
+	encoder
+}
+
+func NewClientEncoder(w io.Writer) *ClientEncoder {
+	return &ClientEncoder{encoder{writer: w}}
+}
+
+// Connect sends CONNECT. Like INFO, it's text unless the encoding was
+// switched to binary before.
+func (e *ClientEncoder) Connect(opts ConnectOptions) error {
+	if e.isBinary() {
+		frame, err := jsonFrame(frameConnect, opts)
+		if err != nil {
+			return err
+		}
+		return e.write(frame)
+	}
+	bts, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	return e.write([]byte(fmt.Sprintf("CONNECT %s\n", bts)))
+}
+
+// Publish sends a PUB op, or HPUB if there are any headers.
+func (e *ClientEncoder) Publish(subject, reply string, header Header, payload []byte) error {
+	if e.isBinary() {
+		f := &frameWriter{b: make([]byte, 0, len(payload)+len(subject)+len(reply)+32)}
+		return e.write(f.str(subject).str(reply).header(header).bytes(payload).frame(framePub))
+	}
+	op, sizes, hdr := msgSizes("PUB", "HPUB", header, payload)
+	buf := bytes.NewBuffer(make([]byte, 0, len(hdr)+len(payload)+len(subject)+len(reply)+32))
+	if reply == "" {
+		fmt.Fprintf(buf, "%s %s %s\n", op, subject, sizes)
+	} else {
+		fmt.Fprintf(buf, "%s %s %s %s\n", op, subject, reply, sizes)
+	}
+	buf.Write(hdr)
+	buf.Write(payload)
+	buf.WriteByte('\n')
+	return e.write(buf.Bytes())
+}
+
+func (e *ClientEncoder) Subscribe(subject string, sid uint64, queue string) error {
+	return e.subscription("SUB", subject, sid, queue)
+}
+
+func (e *ClientEncoder) Unsubscribe(subject string, sid uint64, queue string) error {
+	return e.subscription("UNSUB", subject, sid, queue)
+}
+
+// subscription writes a SUB or UNSUB. A zero sid is left out, which a queue
+// group can't be.
+func (e *ClientEncoder) subscription(op, subject string, sid uint64, queue string) error {
+	if queue != "" && sid == 0 {
+		return fmt.Errorf("queue group %q without a sid", queue)
+	}
+	if e.isBinary() {
+		code := frameSub
+		if op == "UNSUB" {
+			code = frameUnsub
+		}
+		return e.write((&frameWriter{}).str(subject).uvarint(sid).str(queue).frame(code))
+	}
+	switch {
+	case queue != "":
+		return e.write([]byte(fmt.Sprintf("%s %s %d %s\n", op, subject, sid, queue)))
+	case sid != 0:
+		return e.write([]byte(fmt.Sprintf("%s %s %d\n", op, subject, sid)))
+	}
+	return e.write([]byte(fmt.Sprintf("%s %s\n", op, subject)))
+}
+
+// msgSizes picks between the plain and the header variant of a message op and
+// returns it along with its size arguments and the encoded headers.
+func msgSizes(plain, withHeader string, header Header, payload []byte) (op, sizes string, hdr []byte) {
+	if len(header) == 0 {
+		return plain, strconv.Itoa(len(payload)), nil
+	}
+	hdr = encodeHeader(header)
+	return withHeader, fmt.Sprintf("%d %d", len(hdr), len(hdr)+len(payload)), hdr
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrorCode classifies the errors a server sends in -ERR ops.
+type ErrorCode string
+
+const (
+	CodeParse            ErrorCode = "parse_error"
+	CodePayloadTooLarge  ErrorCode = "payload_too_large"
+	CodeAuthFailed       ErrorCode = "auth_failed"
+	CodePermissionDenied ErrorCode = "permission_denied"
+	CodeSlowConsumer     ErrorCode = "slow_consumer"
+	CodeOpFailed         ErrorCode = "op_failed"
+)
+
+// ErrParser is returned by decoders for ops that don't follow the protocol.
+type ErrParser struct {
+	reason string
+}
+
+func (e ErrParser) Error() string {
+	return fmt.Sprintf("parser error: %s", e.reason)
+}
+
+// ErrPayloadTooLarge is returned by decoders for payloads larger than their
+// limit, which they don't read, and by servers to clients that published one
+// before closing the connection.
+type ErrPayloadTooLarge struct {
+	Reason string
+}
+
+func (e ErrPayloadTooLarge) Error() string {
+	return fmt.Sprintf("payload too large: %s", e.Reason)
+}
+
+// ErrAuthorization is returned to clients that send ops before a successful
+// CONNECT on a server that requires authentication.
+type ErrAuthorization struct{}
+
+func (e ErrAuthorization) Error() string { return "authorization violation" }
+
+type ErrPermissionDenied struct {
+	Reason string
+}
+
+func (e ErrPermissionDenied) Error() string {
+	return fmt.Sprintf("permission denied: %s", e.Reason)
+}
+
+// ErrSlowConsumer tells a client that the server dropped messages for it,
+// because it wasn't reading them fast enough.
+type ErrSlowConsumer struct {
+	Reason string
+}
+
+func (e ErrSlowConsumer) Error() string {
+	return fmt.Sprintf("slow consumer: %s", e.Reason)
+}
+
+// ErrOpFailed tells a client that the server couldn't carry out a PUB, SUB
+// or UNSUB it sent, for instance because the network it relays messages over
+// is down.
+type ErrOpFailed struct {
+	Reason string
+}
+
+func (e ErrOpFailed) Error() string {
+	return fmt.Sprintf("op failed: %s", e.Reason)
+}
+
+// ErrServer is an error received from the server with a code this package
+// doesn't know about.
+type ErrServer struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e ErrServer) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("server error: %s", e.Message)
+	}
+	return fmt.Sprintf("server error %s: %s", e.Code, e.Message)
+}
+
+// IsFatal reports whether err, received from a server, ends the connection.
+// After a denied permission, dropped messages or a failed op the connection
+// stays usable.
+func IsFatal(err error) bool {
+	switch err.(type) {
+	case ErrPermissionDenied, ErrSlowConsumer, ErrOpFailed:
+		return false
+	}
+	return true
+}
+
+// codeOf returns the error code and message to send for err in an -ERR op.
+// Errors of unknown types are sent as parse errors, since that's what
+// decoders return.
+func codeOf(err error) (ErrorCode, string) {
+	switch e := err.(type) {
+	case ErrParser:
+		return CodeParse, e.reason
+	case ErrPayloadTooLarge:
+		return CodePayloadTooLarge, e.Reason
+	case ErrAuthorization:
+		return CodeAuthFailed, e.Error()
+	case ErrPermissionDenied:
+		return CodePermissionDenied, e.Reason
+	case ErrSlowConsumer:
+		return CodeSlowConsumer, e.Reason
+	case ErrOpFailed:
+		return CodeOpFailed, e.Reason
+	case ErrServer:
+		return e.Code, e.Message
+	}
+	return CodeParse, err.Error()
+}
+
+// errorOf is the inverse of codeOf.
+func errorOf(code ErrorCode, message string) error {
+	switch code {
+	case CodeParse:
+		return ErrParser{message}
+	case CodePayloadTooLarge:
+		return ErrPayloadTooLarge{message}
+	case CodeAuthFailed:
+		return ErrAuthorization{}
+	case CodePermissionDenied:
+		return ErrPermissionDenied{message}
+	case CodeSlowConsumer:
+		return ErrSlowConsumer{message}
+	case CodeOpFailed:
+		return ErrOpFailed{message}
+	}
+	return ErrServer{code, message}
+}
+
+// validCode reports whether code can be sent in a text -ERR op, which
+// rules out whitespace and leading quotes.
+func validCode(code ErrorCode) bool {
+	return !strings.ContainsAny(string(code), " \t\r\n") &&
+		!strings.HasPrefix(string(code), `"`) && !strings.HasPrefix(string(code), "'")
+}
+
+func encodeErr(err error) []byte {
+	code, message := codeOf(err)
+	return []byte(fmt.Sprintf("-ERR %s %q\n", code, message))
+}
+
+// parseErr parses the arguments of an -ERR op. Servers that predate error
+// codes send only a quoted message.
+func parseErr(args string) (ErrorCode, string) {
+	var code ErrorCode
+	if !strings.HasPrefix(args, `"`) && !strings.HasPrefix(args, "'") {
+		i := strings.IndexAny(args, " \t\r")
+		if i < 0 {
+			return ErrorCode(args), ""
+		}
+		code, args = ErrorCode(args[:i]), args[i+1:]
+	}
+	if message, err := strconv.Unquote(args); err == nil {
+		return code, message
+	}
+	return code, strings.Trim(args, `'"`)
+}
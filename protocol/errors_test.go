@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrRoundTrip(t *testing.T) {
+	for _, err := range []error{
+		ErrParser{"unknown op name"},
+		ErrPayloadTooLarge{"1024 > 512"},
+		ErrAuthorization{},
+		ErrPermissionDenied{`publish to "foo"`},
+		ErrSlowConsumer{"3 messages dropped"},
+		ErrOpFailed{"network is unreachable"},
+		ErrServer{"too_busy", "try later"},
+	} {
+		line := strings.TrimSuffix(string(encodeErr(err)), "\n")
+		assert.True(t, strings.HasPrefix(line, "-ERR "), line)
+		assert.Equal(t, err, errorOf(parseErr(strings.TrimPrefix(line, "-ERR "))), line)
+	}
+}
+
+func TestParseLegacyErr(t *testing.T) {
+	code, message := parseErr(`"unknown op name"`)
+	assert.Equal(t, ErrorCode(""), code)
+	assert.Equal(t, "unknown op name", message)
+	assert.True(t, IsFatal(errorOf(code, message)))
+	assert.False(t, IsFatal(ErrSlowConsumer{}))
+	assert.False(t, IsFatal(ErrOpFailed{}))
+}
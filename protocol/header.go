@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// Header holds the key-value pairs sent with HPUB and HMSG ops. Keys are
+// canonicalized like in MIME headers.
+type Header map[string][]string
+
+func (h Header) Add(key, value string) {
+	textproto.MIMEHeader(h).Add(key, value)
+}
+
+func (h Header) Set(key, value string) {
+	textproto.MIMEHeader(h).Set(key, value)
+}
+
+func (h Header) Get(key string) string {
+	return textproto.MIMEHeader(h).Get(key)
+}
+
+func (h Header) Values(key string) []string {
+	return textproto.MIMEHeader(h).Values(key)
+}
+
+func (h Header) Del(key string) {
+	textproto.MIMEHeader(h).Del(key)
+}
+
+// Clone returns a copy of h.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	c := make(Header, len(h))
+	for k, vs := range h {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
+
+// Validate checks that h can be written on a single line per value.
+func (h Header) Validate() error {
+	for k, vs := range h {
+		if k == "" || strings.ContainsAny(k, ": \t\r\n") {
+			return ErrParser{fmt.Sprintf("invalid header key %q", k)}
+		}
+		for _, v := range vs {
+			if strings.ContainsAny(v, "\r\n") {
+				return ErrParser{fmt.Sprintf("invalid value of header %q", k)}
+			}
+		}
+	}
+	return nil
+}
+
+// headerVersion starts the header section, like in NATS.
+const headerVersion = "NATS/1.0"
+
+// encodeHeader writes h the way NATS does: a "NATS/1.0" line followed by
+// "Key: Value" lines, sorted by key, and an empty line, all ending in "\r\n".
+func encodeHeader(h Header) []byte {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(headerVersion + "\r\n")
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// PayloadSize returns how many bytes a message with header and payload counts
+// against a max_payload limit.
+func PayloadSize(header Header, payload []byte) int {
+	if len(header) == 0 {
+		return len(payload)
+	}
+	return len(encodeHeader(header)) + len(payload)
+}
+
+// decodeHeader parses a header section written by encodeHeader. Lines may
+// also end in a bare "\n", and the version line may go on with a status, which
+// is ignored.
+func decodeHeader(bts []byte) (Header, error) {
+	if !bytes.HasSuffix(bts, []byte("\n")) {
+		return nil, ErrParser{"headers did not end with an empty line"}
+	}
+	lines := strings.Split(string(bts[:len(bts)-1]), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	if len(lines) < 2 || lines[len(lines)-1] != "" {
+		return nil, ErrParser{"headers did not end with an empty line"}
+	}
+	if version := lines[0]; version != headerVersion && !strings.HasPrefix(version, headerVersion+" ") {
+		return nil, ErrParser{fmt.Sprintf("headers did not start with %s", headerVersion)}
+	}
+	h := Header{}
+	for _, line := range lines[1 : len(lines)-1] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, ErrParser{fmt.Sprintf("malformed header line %q", line)}
+		}
+		h.Add(line[:i], strings.TrimLeft(line[i+1:], " "))
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,157 @@
+// Package protocol encodes and decodes the ops of the psycho text protocol.
+// A server reads the ops its clients send with a ServerDecoder and writes its
+// own with a ServerEncoder. A client does the opposite with a ClientEncoder
+// and a ClientDecoder.
+package protocol
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the version of the protocol sent in CONNECT.
+const Version = 1
+
+// DefaultMaxPayload is the largest payload, headers included, that decoders
+// accept unless told otherwise. Servers advertise their own limit as
+// max_payload in INFO.
+const DefaultMaxPayload = 1 << 20
+
+// ConnectOptions are sent by a client in a CONNECT op to identify itself,
+// negotiate the connection and authenticate.
+type ConnectOptions struct {
+	Name     string `json:"name,omitempty"`
+	Protocol int    `json:"protocol"`
+	// Verbose asks the server to acknowledge every op with +OK.
+	Verbose bool `json:"verbose"`
+	// Encoding is the encoding the client switches to after CONNECT and
+	// asks the server to switch to, one of those listed in INFO.
+	Encoding  string `json:"encoding,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	// NoEcho asks the server not to deliver the client's own messages to
+	// its subscriptions.
+	NoEcho bool `json:"no_echo,omitempty"`
+}
+
+// Authorized reports whether the options carry either token or one of the
+// user-password pairs in users. Empty credentials authorize anyone.
+func (o *ConnectOptions) Authorized(token string, users map[string]string) bool {
+	if token == "" && len(users) == 0 {
+		return true
+	}
+	if token != "" && equal(o.AuthToken, token) {
+		return true
+	}
+	pass, ok := users[o.User]
+	return ok && o.User != "" && equal(o.Pass, pass)
+}
+
+// equal compares secrets in constant time, so that timing doesn't give away
+// how much of one a client got right.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func parseConnect(arg []byte) (*ConnectOptions, error) {
+	var opts ConnectOptions
+	if err := json.Unmarshal(arg, &opts); err != nil {
+		return nil, ErrParser{fmt.Sprintf("invalid CONNECT options: %v", err)}
+	}
+	return &opts, nil
+}
+
+type ClientOpType int
+
+const (
+	TypeSubscribe ClientOpType = iota + 1
+	TypeUnsubscribe
+	TypePublish
+	TypePing
+	TypePong
+	TypeConnect
+)
+
+func (t ClientOpType) String() string {
+	switch t {
+	case TypeSubscribe:
+		return "SUB"
+	case TypeUnsubscribe:
+		return "UNSUB"
+	case TypePublish:
+		return "PUB"
+	case TypePing:
+		return "PING"
+	case TypePong:
+		return "PONG"
+	case TypeConnect:
+		return "CONNECT"
+	}
+	return fmt.Sprintf("ClientOpType(%d)", int(t))
+}
+
+// ClientOperation is an op sent by a client.
+type ClientOperation struct {
+	Type    ClientOpType
+	Subject string
+	// SID identifies a subscription in SUB and UNSUB ops. Zero means the
+	// client didn't provide one.
+	SID uint64
+	// Queue is the queue group a SUB or UNSUB op is for, if any.
+	Queue string
+	// Reply is the subject a PUB op asks responses to be published on.
+	Reply string
+	// Header is set by HPUB ops.
+	Header  Header
+	Payload []byte
+	Connect *ConnectOptions
+}
+
+type ServerOpType int
+
+const (
+	TypeInfo ServerOpType = iota + 1
+	TypeMessage
+	TypeOK
+	TypeError
+	TypeServerPing
+	TypeServerPong
+)
+
+func (t ServerOpType) String() string {
+	switch t {
+	case TypeInfo:
+		return "INFO"
+	case TypeMessage:
+		return "MSG"
+	case TypeOK:
+		return "+OK"
+	case TypeError:
+		return "-ERR"
+	case TypeServerPing:
+		return "PING"
+	case TypeServerPong:
+		return "PONG"
+	}
+	return fmt.Sprintf("ServerOpType(%d)", int(t))
+}
+
+// ServerOperation is an op sent by a server.
+type ServerOperation struct {
+	Type    ServerOpType
+	Subject string
+	SID     uint64
+	Reply   string
+	Header  Header
+	// Payload is the payload of a message, the JSON object of an INFO op or
+	// the message of an -ERR op.
+	Payload []byte
+	// Map holds the values of an INFO op. Strings are unquoted and other
+	// values are kept as JSON.
+	Map map[string]string
+	// Code is the error code of an -ERR op and Err the error it stands for.
+	Code ErrorCode
+	Err  error
+}
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// The golden tests decode each testdata/<dir>/*.txt and *.bin file and compare
+// a dump of the ops in it with the .golden file next to it. Files are read
+// with a max_payload of 64 bytes. Those whose names start with "bad_" or
+// "lenient_" aren't in canonical form. The others must come out of the
+// encoders byte for byte as they're decoded, in the binary encoding for .bin
+// files.
+
+func TestServerDecoderGolden(t *testing.T) {
+	golden(t, "client", func(r io.Reader) []string {
+		dec := NewServerDecoder(r)
+		dec.SetMaxPayload(64)
+		var lines []string
+		for {
+			op, err := dec.ReadOperation()
+			if err == io.EOF {
+				return lines
+			}
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("error: %v", err))
+				if IsFatal(err) {
+					return lines
+				}
+				continue
+			}
+			lines = append(lines, dumpClientOp(op))
+		}
+	})
+}
+
+func TestClientDecoderGolden(t *testing.T) {
+	golden(t, "server", func(r io.Reader) []string {
+		dec := NewClientDecoder(r)
+		dec.SetMaxPayload(64)
+		var lines []string
+		for {
+			op, err := dec.ReadOperation()
+			if err == io.EOF {
+				return lines
+			}
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("error: %v", err))
+				if IsFatal(err) {
+					return lines
+				}
+				continue
+			}
+			lines = append(lines, dumpServerOp(op))
+		}
+	})
+}
+
+func TestClientEncoderRoundTrip(t *testing.T) {
+	roundTrip(t, "client", func(in []byte, encoding string) []byte {
+		var out bytes.Buffer
+		dec, enc := NewServerDecoder(bytes.NewReader(in)), NewClientEncoder(&out)
+		enc.SetEncoding(encoding)
+		for {
+			op, err := dec.ReadOperation()
+			if err == io.EOF {
+				return out.Bytes()
+			}
+			require.NoError(t, err)
+			switch op.Type {
+			case TypeConnect:
+				enc.Connect(*op.Connect)
+			case TypePing:
+				enc.Ping()
+			case TypePong:
+				enc.Pong()
+			case TypeSubscribe:
+				enc.Subscribe(op.Subject, op.SID, op.Queue)
+			case TypeUnsubscribe:
+				enc.Unsubscribe(op.Subject, op.SID, op.Queue)
+			case TypePublish:
+				enc.Publish(op.Subject, op.Reply, op.Header, op.Payload)
+			}
+		}
+	})
+}
+
+func TestServerEncoderRoundTrip(t *testing.T) {
+	roundTrip(t, "server", func(in []byte, encoding string) []byte {
+		var out bytes.Buffer
+		dec, enc := NewClientDecoder(bytes.NewReader(in)), NewServerEncoder(&out)
+		enc.SetEncoding(encoding)
+		for {
+			op, err := dec.ReadOperation()
+			if err == io.EOF {
+				return out.Bytes()
+			}
+			require.NoError(t, err)
+			switch op.Type {
+			case TypeInfo:
+				var values map[string]interface{}
+				require.NoError(t, json.Unmarshal(op.Payload, &values))
+				enc.Info(values)
+			case TypeMessage:
+				enc.Msg(op.Subject, op.SID, op.Reply, op.Header, op.Payload)
+			case TypeServerPing:
+				enc.Ping()
+			case TypeServerPong:
+				enc.Pong()
+			case TypeOK:
+				enc.OK()
+			case TypeError:
+				enc.Err(op.Err)
+			}
+		}
+	})
+}
+
+func TestConnectOptionsAuthorized(t *testing.T) {
+	users := map[string]string{"alice": "wonderland", "": "nobody"}
+	for _, tc := range []struct {
+		opts ConnectOptions
+		want bool
+	}{
+		{ConnectOptions{AuthToken: "secret"}, true},
+		{ConnectOptions{AuthToken: "secre"}, false},
+		{ConnectOptions{AuthToken: "secrets"}, false},
+		{ConnectOptions{User: "alice", Pass: "wonderland"}, true},
+		{ConnectOptions{User: "alice", Pass: "wonder"}, false},
+		{ConnectOptions{User: "bob", Pass: "wonderland"}, false},
+		{ConnectOptions{Pass: "nobody"}, false},
+		{ConnectOptions{}, false},
+	} {
+		assert.Equal(t, tc.want, tc.opts.Authorized("secret", users), "%+v", tc.opts)
+	}
+	assert.True(t, (&ConnectOptions{}).Authorized("", nil))
+}
+
+func testdata(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join("testdata", dir, "*.txt"))
+	require.NoError(t, err)
+	bins, err := filepath.Glob(filepath.Join("testdata", dir, "*.bin"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	require.NotEmpty(t, bins)
+	return append(files, bins...)
+}
+
+func golden(t *testing.T, dir string, dump func(io.Reader) []string) {
+	for _, file := range testdata(t, dir) {
+		in, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		got := strings.Join(dump(bytes.NewReader(in)), "\n") + "\n"
+
+		goldenFile := strings.TrimSuffix(file, ".txt") + ".golden"
+		if *update {
+			require.NoError(t, ioutil.WriteFile(goldenFile, []byte(got), 0644))
+			continue
+		}
+		want, err := ioutil.ReadFile(goldenFile)
+		require.NoError(t, err)
+		assert.Equal(t, string(want), got, file)
+	}
+}
+
+func roundTrip(t *testing.T, dir string, reencode func([]byte, string) []byte) {
+	for _, file := range testdata(t, dir) {
+		name := filepath.Base(file)
+		if strings.HasPrefix(name, "bad_") || strings.HasPrefix(name, "lenient_") {
+			continue
+		}
+		encoding := EncodingText
+		if filepath.Ext(file) == ".bin" {
+			encoding = EncodingBinary
+		}
+		in, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, string(in), string(reencode(in, encoding)), file)
+	}
+}
+
+func dumpClientOp(op ClientOperation) string {
+	fields := []string{op.Type.String()}
+	if op.Connect != nil {
+		bts, _ := json.Marshal(op.Connect)
+		fields = append(fields, string(bts))
+	}
+	return strings.Join(append(fields, dumpMsg(op.Subject, op.SID, op.Queue, op.Reply, op.Header, op.Payload)...), " ")
+}
+
+func dumpServerOp(op ServerOperation) string {
+	fields := []string{op.Type.String()}
+	if op.Map != nil {
+		bts, _ := json.Marshal(op.Map)
+		fields = append(fields, string(bts))
+		op.Payload = nil
+	}
+	if op.Type == TypeError {
+		fields = append(fields, fmt.Sprintf("code=%q", op.Code), fmt.Sprintf("err=%q", op.Err))
+	}
+	return strings.Join(append(fields, dumpMsg(op.Subject, op.SID, "", op.Reply, op.Header, op.Payload)...), " ")
+}
+
+func dumpMsg(subj string, sid uint64, queue, reply string, header Header, payload []byte) []string {
+	var fields []string
+	if subj != "" {
+		fields = append(fields, fmt.Sprintf("subject=%q", subj))
+	}
+	if sid != 0 {
+		fields = append(fields, fmt.Sprintf("sid=%d", sid))
+	}
+	if queue != "" {
+		fields = append(fields, fmt.Sprintf("queue=%q", queue))
+	}
+	if reply != "" {
+		fields = append(fields, fmt.Sprintf("reply=%q", reply))
+	}
+	if header != nil {
+		var kvs []string
+		for k, vs := range header {
+			for _, v := range vs {
+				kvs = append(kvs, k+": "+v)
+			}
+		}
+		sort.Strings(kvs)
+		fields = append(fields, fmt.Sprintf("header=%q", kvs))
+	}
+	if payload != nil {
+		fields = append(fields, fmt.Sprintf("payload=%q", payload))
+	}
+	return fields
+}
@@ -1,170 +1,247 @@
 package psycho
 
 import (
-	"bufio"
-	"encoding/json"
-	"fmt"
-	"io"
-	"strings"
+	"context"
+	"sync"
+
+	"github.com/Gaboose/psycho/internal/closer"
+	"github.com/Gaboose/psycho/protocol"
 )
 
 type Server interface {
 	Pub(subject string, payload []byte)
 	Sub(subject string)
 	Unsub(subject string)
-	ServeServerOpsTo(client Client)
+	ServeServerOpsTo(handler Handler)
 }
 
-type ErrParser struct {
-	reason string
+// Handler receives the INFO and the messages of a Server. ServerCodec is one,
+// passing them on to a client of the protocol.
+type Handler interface {
+	HandleInfo(info map[string]interface{})
+	HandleMsg(subject string, payload []byte)
 }
 
-func (e ErrParser) Error() string {
-	return fmt.Sprintf("parser error: %s", e.reason)
+// ClientHandler is an alias of Handler, for servers written before the Client
+// interface was renamed.
+//
+// Deprecated: Use Handler.
+type ClientHandler = Handler
+
+// ReplyServer is a Server that can carry a reply subject along with a
+// published message. Such servers deliver messages through HandleReplyMsg to
+// handlers that implement ReplyHandler.
+type ReplyServer interface {
+	Server
+	PubReply(subject, reply string, payload []byte)
 }
 
-type ClientOpType int
+// QueueServer is a Server that supports queue groups. Of all subscriptions
+// in the same queue group only one receives each message.
+type QueueServer interface {
+	Server
+	QueueSub(subject, queue string)
+	QueueUnsub(subject, queue string)
+}
 
-const (
-	TypeSubscribe ClientOpType = iota + 1
-	TypeUnsubscribe
-	TypePublish
-)
+// HeaderServer is a Server that can carry headers along with a published
+// message. Such servers deliver messages through HandleHeaderMsg to
+// handlers that implement HeaderHandler.
+type HeaderServer interface {
+	Server
+	PubHeader(subject, reply string, header Header, payload []byte)
+}
 
-type ClientOperation struct {
-	Type    ClientOpType
-	Subject string
-	Payload []byte
-	Error   error
+// ReplyHandler is a Handler that can receive the reply subject of a message.
+type ReplyHandler interface {
+	Handler
+	HandleReplyMsg(subject, reply string, payload []byte)
 }
 
-type ServerDecoder struct {
-	reader *bufio.Reader
+// HeaderHandler is a Handler that can receive the reply subject and headers
+// of a message.
+type HeaderHandler interface {
+	Handler
+	HandleHeaderMsg(subject, reply string, header Header, payload []byte)
 }
 
-func NewServerDecoder(r io.Reader) *ServerDecoder {
-	return &ServerDecoder{
-		reader: bufio.NewReader(r),
-	}
+// SubHandler is a Handler that can tell which of the server's subscriptions a
+// message was delivered for. Servers that deliver a copy of a message for
+// every subscription it matches, rather than one per message, deliver through
+// HandleSubMsg to such handlers, so that each copy reaches only the
+// subscriptions behind it. Pattern and queue are those the server was
+// subscribed with.
+type SubHandler interface {
+	HeaderHandler
+	HandleSubMsg(pattern, queue, subject, reply string, header Header, payload []byte)
 }
 
-func (p *ServerDecoder) ReadOperation() (ClientOperation, bool) {
-	line, err := p.reader.ReadString('\n')
-	if err == io.EOF {
-		return ClientOperation{Error: io.EOF}, false
-	} else if err != nil {
-		return ClientOperation{Error: ErrParser{"reading new line"}}, false
+// Publish publishes a message on server with the most specific method it
+// implements. Reply and header are dropped if the server can't carry them.
+func Publish(server Server, subject, reply string, header Header, payload []byte) {
+	if hs, ok := server.(HeaderServer); ok && len(header) > 0 {
+		hs.PubHeader(subject, reply, header, payload)
+	} else if rs, ok := server.(ReplyServer); ok && reply != "" {
+		rs.PubReply(subject, reply, payload)
+	} else {
+		server.Pub(subject, payload)
 	}
-	tokens := strings.Split(line[:len(line)-1], " ")
+}
 
-	if len(tokens) < 2 {
-		return ClientOperation{Error: ErrParser{
-			fmt.Sprintf("expected 2 or more tokens, found %d", len(tokens)),
-		}}, false
+// Deliver passes a message to handler with the most specific method it
+// implements. Reply and header are dropped if the handler can't take them.
+func Deliver(handler Handler, subject, reply string, header Header, payload []byte) {
+	if hh, ok := handler.(HeaderHandler); ok {
+		hh.HandleHeaderMsg(subject, reply, header, payload)
+	} else if rh, ok := handler.(ReplyHandler); ok {
+		rh.HandleReplyMsg(subject, reply, payload)
+	} else {
+		handler.HandleMsg(subject, payload)
 	}
+}
 
-	switch tokens[0] {
-	case "SUB":
-		if len(tokens) != 2 {
-			return ClientOperation{Error: ErrParser{
-				fmt.Sprintf("SUB op expects exactly 1 argument, found %d", len(tokens)-1),
-			}}, false
-		}
-		return ClientOperation{
-			Type:    TypeSubscribe,
-			Subject: tokens[1],
-		}, true
-	case "UNSUB":
-		if len(tokens) != 2 {
-			return ClientOperation{Error: ErrParser{
-				fmt.Sprintf("UNSUB op expects exactly 1 argument, found %d", len(tokens)-1),
-			}}, false
-		}
-		return ClientOperation{
-			Type:    TypeUnsubscribe,
-			Subject: tokens[1],
-		}, true
-	case "PUB":
-		if len(tokens) != 3 {
-			return ClientOperation{Error: ErrParser{
-				fmt.Sprintf("PUB op expects exactly 2 arguments, found %d", len(tokens)-1),
-			}}, false
-		}
-		payload, err := readPayload(p.reader, tokens[2])
-		if err != nil {
-			return ClientOperation{Error: ErrParser{fmt.Sprintf("reading payload: %v", err)}}, false
-		}
-		return ClientOperation{
-			Type:    TypePublish,
-			Subject: tokens[1],
-			Payload: payload,
-		}, true
-	default:
-		return ClientOperation{Error: ErrParser{"unknown op name"}}, false
+// DeliverSub passes a message delivered for the server's subscription to
+// pattern and queue to handler. Handlers that aren't SubHandlers get it
+// through Deliver, and with it any copies delivered for other subscriptions.
+func DeliverSub(handler Handler, pattern, queue, subject, reply string, header Header, payload []byte) {
+	if sh, ok := handler.(SubHandler); ok {
+		sh.HandleSubMsg(pattern, queue, subject, reply, header, payload)
+	} else {
+		Deliver(handler, subject, reply, header, payload)
 	}
 }
 
-type ServerEncoder struct {
-	writer io.Writer
+// ServerV2 is a server whose ops take a context and report whether they were
+// carried out, and that can be shut down. Unlike those of a Server, its ops
+// carry whatever a message or subscription has: Pub takes a reply subject and
+// headers, and Sub and Unsub a queue group, any of which may be empty.
+// Subscribing to the same subject and queue group twice has no more effect
+// than once.
+//
+// ServeServerOpsTo delivers the INFO and then messages to handler until the
+// server is closed, and returns nil then, or the error that stopped it
+// earlier. After Close, ops return ErrServerClosed.
+type ServerV2 interface {
+	Pub(ctx context.Context, subject, reply string, header Header, payload []byte) error
+	Sub(ctx context.Context, subject, queue string) error
+	Unsub(ctx context.Context, subject, queue string) error
+	ServeServerOpsTo(handler Handler) error
+	Close() error
 }
 
-func NewServerEncoder(w io.Writer) *ServerEncoder {
-	return &ServerEncoder{
-		writer: w,
+// ErrServerClosed is returned by the ops of a closed ServerV2.
+type ErrServerClosed = closer.ErrServerClosed
+
+// AdaptServer returns a ServerV2 that carries out its ops on server, which
+// can't fail them. Reply subjects, headers and queue groups are dropped if
+// server can't carry them; a queue subscription is then a plain one. Close
+// closes server too if it has a Close method.
+func AdaptServer(server Server) ServerV2 {
+	a := &serverAdapter{
+		server: server,
+		subs:   map[subKey]struct{}{},
 	}
+	a.queues, _ = server.(QueueServer)
+	return a
+}
+
+type serverAdapter struct {
+	server Server
+	queues QueueServer
+
+	// subs are the subscriptions made, by subject and queue group. Without
+	// queue group support, there's only one for each subject.
+	subs map[subKey]struct{}
+	mu   sync.Mutex
+
+	closer closer.Closer
 }
 
-func (e *ServerEncoder) Info(values map[string]interface{}) error {
-	bts, err := json.Marshal(values)
-	if err != nil {
+func (a *serverAdapter) Pub(ctx context.Context, subject, reply string, header Header, payload []byte) error {
+	if err := a.closer.Check(ctx); err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(e.writer, "INFO %s\n", string(bts))
-	return err
+	Publish(a.server, subject, reply, header, payload)
+	return nil
 }
 
-func (e *ServerEncoder) Msg(subject string, payload []byte) error {
-	_, err := fmt.Fprintf(e.writer, "MSG %s %d\n%s\n", subject, len(payload), string(payload))
-	return err
+func (a *serverAdapter) Sub(ctx context.Context, subject, queue string) error {
+	if err := a.closer.Check(ctx); err != nil {
+		return err
+	}
+	key := a.key(subject, queue)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.subs[key]; ok {
+		return nil
+	}
+	a.subs[key] = struct{}{}
+	if key.queue != "" {
+		a.queues.QueueSub(key.subject, key.queue)
+	} else {
+		a.server.Sub(key.subject)
+	}
+	return nil
 }
 
-func (e *ServerEncoder) OK() error {
-	_, err := e.writer.Write([]byte("+OK\n"))
-	return err
+func (a *serverAdapter) Unsub(ctx context.Context, subject, queue string) error {
+	if err := a.closer.Check(ctx); err != nil {
+		return err
+	}
+	key := a.key(subject, queue)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.subs[key]; !ok {
+		return nil
+	}
+	delete(a.subs, key)
+	if key.queue != "" {
+		a.queues.QueueUnsub(key.subject, key.queue)
+	} else {
+		a.server.Unsub(key.subject)
+	}
+	return nil
 }
 
-func (e *ServerEncoder) Err(message string) error {
-	_, err := fmt.Fprintf(e.writer, "-ERR %q\n", message)
-	return err
+// key returns the key of the server's subscription for subject and queue.
+func (a *serverAdapter) key(subject, queue string) subKey {
+	if a.queues == nil {
+		return subKey{subject: subject}
+	}
+	return subKey{subject: subject, queue: queue}
 }
 
-func (e *ServerEncoder) OKErr(err error) {
-	if err == nil {
-		e.OK()
-		return
+// ServeServerOpsTo serves the server's ops to handler, and then waits for
+// Close, since servers may stop early when they have nothing to deliver.
+func (a *serverAdapter) ServeServerOpsTo(handler Handler) error {
+	if err := a.closer.Check(context.Background()); err != nil {
+		return err
 	}
-	e.Err(err.Error())
-}
-
-// func readPayload(reader *bufio.Reader, nbytes string) ([]byte, error) {
-// 	n, err := strconv.ParseUint(nbytes, 10, 64)
-// 	if err != nil {
-// 		return nil, errors.New("parsing number of bytes")
-// 	}
-// 	var payload = make([]byte, n)
-// 	nread, err := reader.Read(payload)
-// 	if nread < int(n) {
-// 		return nil, fmt.Errorf("expected to read %d bytes, but only read %d", n, nread)
-// 	}
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	delim, err := reader.ReadString('\n')
-// 	if delim != "\n" {
-// 		return nil, fmt.Errorf("payload did not end with a new line")
-// 	}
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return payload, nil
-// }
+	a.server.ServeServerOpsTo(handler)
+	<-a.closer.Closing()
+	return nil
+}
+
+func (a *serverAdapter) Close() error {
+	return a.closer.Close(func() error {
+		switch server := a.server.(type) {
+		case interface{ Close() error }:
+			return server.Close()
+		case interface{ Close() }:
+			server.Close()
+		}
+		return nil
+	})
+}
+
+// ProtocolVersion is the version of the protocol sent in CONNECT.
+const ProtocolVersion = protocol.Version
+
+// DefaultMaxPayload is the largest payload, headers included, that decoders
+// accept unless told otherwise. Servers advertise their own limit as
+// max_payload in INFO.
+const DefaultMaxPayload = protocol.DefaultMaxPayload
+
+// ConnectOptions are sent by a client in a CONNECT op. See
+// protocol.ConnectOptions.
+type ConnectOptions = protocol.ConnectOptions
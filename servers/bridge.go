@@ -0,0 +1,197 @@
+package servers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/internal/closer"
+	"github.com/Gaboose/psycho/subject"
+)
+
+// BridgeIDHeader is the header that carries the ID a Bridge gives every
+// message it forwards.
+const BridgeIDHeader = "Psycho-Bridge-Id"
+
+// BridgeConfig sets the subjects a Bridge forwards, wildcards allowed.
+type BridgeConfig struct {
+	// AToB are the subjects forwarded from the first server to the second.
+	AToB []string
+	// BToA are the subjects forwarded from the second server to the first.
+	BToA []string
+}
+
+// Bridge forwards messages between two servers on different networks, such
+// as a Multicast and a NATS, so that the clients on either can talk to those
+// on the other.
+//
+// A message gets an ID in its BridgeIDHeader when it first crosses a bridge,
+// and keeps it across the others. A bridge forwards a message with a given ID
+// once, so that messages don't loop between networks joined by more than one
+// bridge, or by one over servers that echo.
+//
+// Servers that don't say "headers": true in their INFO, such as NATS before
+// 2.2, get messages without headers. A bridge tells the copies of those
+// that come back by their subject, reply subject and payload instead, and so
+// also drops a message identical to one it forwarded to such a server in the
+// last 10 seconds.
+//
+// Reply subjects are forwarded as they are, so requests get replies only if
+// those are forwarded back.
+type Bridge struct {
+	a, b *bridgeSide
+	seen *seenNonces
+
+	closer closer.Closer
+}
+
+// bridgeSide is one of a Bridge's servers, and the subjects forwarded from
+// it.
+type bridgeSide struct {
+	server   psycho.ServerV2
+	subjects []string
+	// info is closed once the server's INFO arrives, which says in headers
+	// whether it carries them.
+	info    chan struct{}
+	headers bool
+}
+
+// NewBridge subscribes a and b to the subjects to forward from them. If that
+// fails, closing them is left to the caller.
+func NewBridge(ctx context.Context, a, b psycho.ServerV2, config BridgeConfig) (*Bridge, error) {
+	for _, subj := range config.AToB {
+		if err := a.Sub(ctx, subj, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, subj := range config.BToA {
+		if err := b.Sub(ctx, subj, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &Bridge{
+		a: &bridgeSide{server: a, subjects: config.AToB, info: make(chan struct{})},
+		b: &bridgeSide{server: b, subjects: config.BToA, info: make(chan struct{})},
+		seen: &seenNonces{
+			set: map[string]struct{}{},
+			ttl: 10 * time.Second,
+		},
+	}, nil
+}
+
+// Serve forwards messages until the bridge is closed or either server fails,
+// and closes the bridge then.
+func (br *Bridge) Serve() error {
+	errs := make(chan error, 2)
+	go func() { errs <- br.a.server.ServeServerOpsTo(bridgeHandler{br, br.a, br.b}) }()
+	go func() { errs <- br.b.server.ServeServerOpsTo(bridgeHandler{br, br.b, br.a}) }()
+	err := <-errs
+	br.Close()
+	<-errs
+	return err
+}
+
+// Close closes both servers.
+func (br *Bridge) Close() error {
+	return br.closer.Close(func() error {
+		err := br.a.server.Close()
+		if bErr := br.b.server.Close(); err == nil {
+			err = bErr
+		}
+		return err
+	})
+}
+
+// bridgeHandler forwards the messages on the subjects of one side to the
+// other.
+type bridgeHandler struct {
+	bridge   *Bridge
+	from, to *bridgeSide
+}
+
+func (h bridgeHandler) HandleInfo(info map[string]interface{}) {
+	h.from.headers, _ = info["headers"].(bool)
+	close(h.from.info)
+}
+
+func (h bridgeHandler) HandleMsg(subj string, payload []byte) {
+	h.forward(subj, "", nil, payload)
+}
+
+func (h bridgeHandler) HandleHeaderMsg(subj, reply string, header psycho.Header, payload []byte) {
+	h.forward(subj, reply, header, payload)
+}
+
+// HandleSubMsg forwards the copy delivered for the first of the subjects
+// that match, since servers that deliver a copy for each would have the
+// message forwarded as many times.
+func (h bridgeHandler) HandleSubMsg(pattern, queue, subj, reply string, header psycho.Header, payload []byte) {
+	for _, s := range h.from.subjects {
+		if subject.Match(s, subj) {
+			if s == pattern {
+				h.forward(subj, reply, header, payload)
+			}
+			return
+		}
+	}
+}
+
+func (h bridgeHandler) forward(subj, reply string, header psycho.Header, payload []byte) {
+	// Whether the message can keep its ID depends on the other side's INFO.
+	select {
+	case <-h.to.info:
+	case <-h.bridge.closer.Closing():
+		return
+	}
+	id := header.Get(BridgeIDHeader)
+	digest := ""
+	if !h.from.headers || !h.to.headers {
+		digest = bridgeDigest(subj, reply, payload)
+	}
+	if id == "" && !h.from.headers {
+		// It may be a copy of one forwarded to this side, without its ID.
+		if h.bridge.seen.Seen(digest) {
+			return
+		}
+	}
+	if id == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Println(err)
+			return
+		}
+		id = hex.EncodeToString(b)
+	}
+	if h.bridge.seen.Seen(id) {
+		return
+	}
+	if h.to.headers {
+		header = header.Clone()
+		if header == nil {
+			header = psycho.Header{}
+		}
+		header.Set(BridgeIDHeader, id)
+	} else {
+		header = nil
+		// Its copies will come back without the ID. A message from the
+		// other side without headers was checked already.
+		if h.from.headers && h.bridge.seen.Seen(digest) {
+			return
+		}
+	}
+	if err := h.to.server.Pub(context.Background(), subj, reply, header, payload); err != nil {
+		log.Printf("forwarding message on subject %v: %v", subj, err)
+	}
+}
+
+// bridgeDigest returns what tells a message apart from others without an ID.
+func bridgeDigest(subj, reply string, payload []byte) string {
+	d := sha256.New()
+	d.Write([]byte(subj + "\x00" + reply + "\x00"))
+	d.Write(payload)
+	return "digest:" + hex.EncodeToString(d.Sum(nil))
+}
@@ -0,0 +1,90 @@
+package servers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Gaboose/psycho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bridge bridges hubs a and b until the end of the test.
+func bridge(t *testing.T, a, b *MemoryHub, config BridgeConfig) {
+	bridgeServers(t, a.Attach().V2(), b.Attach().V2(), config)
+}
+
+// bridgeServers bridges a and b until the end of the test.
+func bridgeServers(t *testing.T, a, b psycho.ServerV2, config BridgeConfig) {
+	br, err := NewBridge(context.Background(), a, b, config)
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- br.Serve() }()
+	t.Cleanup(func() {
+		require.NoError(t, br.Close())
+		assert.NoError(t, <-served)
+	})
+}
+
+func TestBridge(t *testing.T) {
+	hubA, hubB := NewMemoryHub(MemoryConfig{}), NewMemoryHub(MemoryConfig{})
+	bridge(t, hubA, hubB, BridgeConfig{AToB: []string{"foo.>"}, BToA: []string{"bar"}})
+	a, aMsgs := serve(t, hubA)
+	b, bMsgs := serve(t, hubB)
+	a.Sub(">")
+	b.Sub(">")
+
+	a.Pub("foo.bar", []byte("a to b"))
+	a.Pub("baz", []byte("not forwarded"))
+	assert.Equal(t, []string{"a to b"}, collect(bMsgs, 2))
+
+	b.Pub("bar", []byte("b to a"))
+	b.Pub("foo.bar", []byte("not forwarded"))
+	assert.Equal(t, []string{"b to a"}, collect(aMsgs, 2))
+}
+
+func TestBridgeLoop(t *testing.T) {
+	// Two bridges both ways would pass messages back and forth forever if
+	// they didn't remember them, and so would one over servers that echo.
+	hubA, hubB := NewMemoryHub(MemoryConfig{Echo: true}), NewMemoryHub(MemoryConfig{Echo: true})
+	all := BridgeConfig{AToB: []string{">"}, BToA: []string{">"}}
+	bridge(t, hubA, hubB, all)
+	bridge(t, hubA, hubB, all)
+	a, _ := serve(t, hubA)
+	b, bMsgs := serve(t, hubB)
+	b.Sub("foo")
+
+	// Each bridge forwards it once.
+	a.Pub("foo", []byte("hi"))
+	assert.Equal(t, []string{"hi", "hi"}, collect(bMsgs, 3))
+}
+
+func TestBridgeWithoutHeaders(t *testing.T) {
+	// NATS before 2.2 can't carry the IDs, so copies are told apart by
+	// their content.
+	newNATS := runNATS(t)
+	hub := NewMemoryHub(MemoryConfig{})
+	all := BridgeConfig{AToB: []string{">"}, BToA: []string{">"}}
+	bridgeServers(t, hub.Attach().V2(), newNATS(t), all)
+	bridgeServers(t, hub.Attach().V2(), newNATS(t), all)
+	m, mMsgs := serve(t, hub)
+	m.Sub("foo")
+	n := newNATS(t)
+	nMsgs := make(payloads, 100)
+	go n.ServeServerOpsTo(nMsgs)
+	t.Cleanup(func() { n.Close() })
+	require.NoError(t, n.Sub(context.Background(), "foo", ""))
+
+	// Each bridge forwards a message at most once.
+	m.Pub("foo", []byte("from memory"))
+	got := collect(nMsgs, 10)
+	assert.NotEmpty(t, got)
+	assert.LessOrEqual(t, len(got), 2)
+	assert.LessOrEqual(t, len(collect(mMsgs, 10)), 2)
+
+	require.NoError(t, n.Pub(context.Background(), "foo", "", nil, []byte("from nats")))
+	got = collect(mMsgs, 10)
+	assert.NotEmpty(t, got)
+	assert.LessOrEqual(t, len(got), 2)
+	assert.LessOrEqual(t, len(collect(nMsgs, 10)), 2)
+}
@@ -0,0 +1,353 @@
+package servers
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/internal/closer"
+	"github.com/Gaboose/psycho/subject"
+)
+
+// MemoryConfig sets how a MemoryHub passes messages on. The zero value
+// delivers every message, in order and right away, to every client but the
+// one that published it.
+type MemoryConfig struct {
+	// Echo delivers a client's messages to its own subscriptions too.
+	Echo bool
+	// Latency delays every message by as much.
+	Latency time.Duration
+	// Jitter delays every message by up to as much again as Latency, picked
+	// at random, which reorders messages sent less than Jitter apart.
+	Jitter time.Duration
+	// Loss is the probability, from 0 to 1, that a message doesn't reach a
+	// client.
+	Loss float64
+	// Seed seeds the choice of lost messages, of their delays and of the
+	// queue group members that receive them, so that runs with the same
+	// seed choose alike.
+	Seed int64
+}
+
+// MemoryHub passes messages between the Memory servers attached to it, all
+// in one process, for tests and apps that don't need a network.
+type MemoryHub struct {
+	config MemoryConfig
+	rand   *rand.Rand
+
+	// peers are the attached servers, in the order they were attached.
+	peers []*Memory
+	mu    sync.Mutex
+}
+
+func NewMemoryHub(config MemoryConfig) *MemoryHub {
+	return &MemoryHub{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+// Attach returns a new server on the hub, for one client.
+func (h *MemoryHub) Attach() *Memory {
+	m := &Memory{
+		hub:  h,
+		wake: make(chan struct{}, 1),
+	}
+	h.mu.Lock()
+	h.peers = append(h.peers, m)
+	h.mu.Unlock()
+	return m
+}
+
+func (h *MemoryHub) detach(m *Memory) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, peer := range h.peers {
+		if peer == m {
+			h.peers = append(h.peers[:i], h.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// publish delivers msg to every subscription of the attached servers it
+// matches, except that of the subscriptions with the same subject and queue
+// group only one gets it.
+func (h *MemoryHub) publish(from *Memory, msg memoryMsg) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	deliver := func(m *Memory, sub memorySub) {
+		if h.config.Loss > 0 && h.rand.Float64() < h.config.Loss {
+			return
+		}
+		var due time.Time
+		if h.config.Latency > 0 || h.config.Jitter > 0 {
+			due = now.Add(h.config.Latency)
+			if h.config.Jitter > 0 {
+				due = due.Add(time.Duration(h.rand.Int63n(int64(h.config.Jitter))))
+			}
+		}
+		m.push(&memoryDelivery{sub: sub, msg: msg, due: due})
+	}
+
+	groups := map[memorySub][]*Memory{}
+	var order []memorySub
+	for _, m := range h.peers {
+		if m == from && !h.config.Echo {
+			continue
+		}
+		for _, sub := range m.matching(msg.subject) {
+			if sub.queue == "" {
+				deliver(m, sub)
+				continue
+			}
+			if _, ok := groups[sub]; !ok {
+				order = append(order, sub)
+			}
+			groups[sub] = append(groups[sub], m)
+		}
+	}
+	for _, sub := range order {
+		members := groups[sub]
+		deliver(members[h.rand.Intn(len(members))], sub)
+	}
+}
+
+// Memory is a server on a MemoryHub. Like NATS, it delivers a copy of a
+// message for each of its subscriptions the message matches, and of those in
+// a queue group, only one across the hub gets it.
+type Memory struct {
+	hub *MemoryHub
+
+	// subs are the subscriptions made, in the order they were made.
+	subs   []memorySub
+	subsMu sync.Mutex
+
+	// inbox holds the messages due for delivery, and wake is signalled when
+	// one is added.
+	inbox   memoryInbox
+	seq     uint64
+	wake    chan struct{}
+	inboxMu sync.Mutex
+
+	closer closer.Closer
+}
+
+type memorySub struct {
+	subject string
+	queue   string
+}
+
+type memoryMsg struct {
+	subject string
+	reply   string
+	header  psycho.Header
+	payload []byte
+}
+
+type memoryDelivery struct {
+	sub memorySub
+	msg memoryMsg
+	due time.Time
+	seq uint64
+}
+
+func (m *Memory) Pub(subject string, payload []byte) {
+	m.PubHeader(subject, "", nil, payload)
+}
+
+func (m *Memory) PubReply(subject, reply string, payload []byte) {
+	m.PubHeader(subject, reply, nil, payload)
+}
+
+func (m *Memory) PubHeader(subject, reply string, header psycho.Header, payload []byte) {
+	// The caller may reuse payload, and every subscriber gets the same copy.
+	msg := memoryMsg{
+		subject: subject,
+		reply:   reply,
+		header:  header.Clone(),
+		payload: append([]byte(nil), payload...),
+	}
+	m.hub.publish(m, msg)
+}
+
+func (m *Memory) Sub(subject string) {
+	m.QueueSub(subject, "")
+}
+
+func (m *Memory) Unsub(subject string) {
+	m.QueueUnsub(subject, "")
+}
+
+func (m *Memory) QueueSub(subject, queue string) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	for _, sub := range m.subs {
+		if sub == (memorySub{subject, queue}) {
+			return
+		}
+	}
+	m.subs = append(m.subs, memorySub{subject, queue})
+}
+
+func (m *Memory) QueueUnsub(subject, queue string) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	for i, sub := range m.subs {
+		if sub == (memorySub{subject, queue}) {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// matching returns the subscriptions that match subj.
+func (m *Memory) matching(subj string) []memorySub {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	var subs []memorySub
+	for _, sub := range m.subs {
+		if subject.Match(sub.subject, subj) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+func (m *Memory) push(d *memoryDelivery) {
+	m.inboxMu.Lock()
+	m.seq++
+	d.seq = m.seq
+	heap.Push(&m.inbox, d)
+	m.inboxMu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the earliest due delivery and how long until it's due,
+// removing it from the inbox if that's no time at all.
+func (m *Memory) next() (*memoryDelivery, time.Duration) {
+	m.inboxMu.Lock()
+	defer m.inboxMu.Unlock()
+	if len(m.inbox) == 0 {
+		return nil, 0
+	}
+	// Deliveries without a due time are due at once.
+	next, wait := m.inbox[0], time.Until(m.inbox[0].due)
+	if wait <= 0 {
+		heap.Pop(&m.inbox)
+	}
+	return next, wait
+}
+
+// ServeServerOpsTo delivers messages to handler, each once it's due, until m
+// is closed.
+func (m *Memory) ServeServerOpsTo(handler psycho.Handler) {
+	handler.HandleInfo(map[string]interface{}{
+		"type":        "memory",
+		"version":     "0.1",
+		"max_payload": psycho.DefaultMaxPayload,
+		"headers":     true,
+	})
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next, wait := m.next()
+		if next != nil && wait <= 0 {
+			psycho.DeliverSub(handler, next.sub.subject, next.sub.queue, next.msg.subject, next.msg.reply, next.msg.header, next.msg.payload)
+			continue
+		}
+		var due <-chan time.Time
+		if next != nil {
+			// A stale tick only makes the loop look again.
+			timer.Stop()
+			timer.Reset(wait)
+			due = timer.C
+		}
+		select {
+		case <-due:
+		case <-m.wake:
+		case <-m.closer.Closing():
+			return
+		}
+	}
+}
+
+// Close detaches m from its hub and stops ServeServerOpsTo. Messages not
+// delivered yet are dropped.
+func (m *Memory) Close() error {
+	return m.closer.Close(func() error {
+		m.hub.detach(m)
+		return nil
+	})
+}
+
+// V2 returns m as a psycho.ServerV2.
+func (m *Memory) V2() psycho.ServerV2 {
+	return memoryV2{m}
+}
+
+type memoryV2 struct {
+	m *Memory
+}
+
+func (v memoryV2) Pub(ctx context.Context, subject, reply string, header psycho.Header, payload []byte) error {
+	if err := v.m.closer.Check(ctx); err != nil {
+		return err
+	}
+	v.m.PubHeader(subject, reply, header, payload)
+	return nil
+}
+
+func (v memoryV2) Sub(ctx context.Context, subject, queue string) error {
+	if err := v.m.closer.Check(ctx); err != nil {
+		return err
+	}
+	v.m.QueueSub(subject, queue)
+	return nil
+}
+
+func (v memoryV2) Unsub(ctx context.Context, subject, queue string) error {
+	if err := v.m.closer.Check(ctx); err != nil {
+		return err
+	}
+	v.m.QueueUnsub(subject, queue)
+	return nil
+}
+
+func (v memoryV2) ServeServerOpsTo(handler psycho.Handler) error {
+	v.m.ServeServerOpsTo(handler)
+	return nil
+}
+
+func (v memoryV2) Close() error {
+	return v.m.Close()
+}
+
+// memoryInbox is a heap of deliveries, earliest due first, and in the order
+// they were pushed if equally due.
+type memoryInbox []*memoryDelivery
+
+func (q memoryInbox) Len() int      { return len(q) }
+func (q memoryInbox) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q memoryInbox) Less(i, j int) bool {
+	if !q[i].due.Equal(q[j].due) {
+		return q[i].due.Before(q[j].due)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q *memoryInbox) Push(x interface{}) { *q = append(*q, x.(*memoryDelivery)) }
+
+func (q *memoryInbox) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
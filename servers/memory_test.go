@@ -0,0 +1,159 @@
+package servers
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// payloads is a handler that passes on the payloads it receives.
+type payloads chan string
+
+func (h payloads) HandleInfo(map[string]interface{})     {}
+func (h payloads) HandleMsg(subj string, payload []byte) { h <- string(payload) }
+
+// serve attaches a server to hub and serves it to a handler.
+func serve(t *testing.T, hub *MemoryHub) (*Memory, payloads) {
+	m := hub.Attach()
+	h := make(payloads, 100)
+	go m.ServeServerOpsTo(h)
+	t.Cleanup(func() { m.Close() })
+	return m, h
+}
+
+// collect receives n payloads, or fewer if no more arrive for a while.
+func collect(h payloads, n int) []string {
+	var got []string
+	for len(got) < n {
+		select {
+		case p := <-h:
+			got = append(got, p)
+		case <-time.After(200 * time.Millisecond):
+			return got
+		}
+	}
+	return got
+}
+
+func publishN(m *Memory, subj string, n int) []string {
+	var sent []string
+	for i := 0; i < n; i++ {
+		sent = append(sent, strconv.Itoa(i))
+		m.Pub(subj, []byte(sent[i]))
+	}
+	return sent
+}
+
+func TestMemory(t *testing.T) {
+	hub := NewMemoryHub(MemoryConfig{})
+	a, aMsgs := serve(t, hub)
+	b, bMsgs := serve(t, hub)
+	a.Sub("foo")
+	b.Sub("foo")
+
+	// Messages arrive in order, and not back at their publisher.
+	sent := publishN(a, "foo", 10)
+	assert.Equal(t, sent, collect(bMsgs, 10))
+	assert.Empty(t, collect(aMsgs, 1))
+
+	b.Unsub("foo")
+	a.Pub("foo", nil)
+	assert.Empty(t, collect(bMsgs, 1))
+
+	// A closed server no longer receives.
+	b.Sub("foo")
+	require.NoError(t, b.Close())
+	a.Pub("foo", nil)
+	assert.Empty(t, collect(bMsgs, 1))
+}
+
+func TestMemoryEcho(t *testing.T) {
+	m, msgs := serve(t, NewMemoryHub(MemoryConfig{Echo: true}))
+	m.Sub("foo")
+	m.Pub("foo", []byte("hi"))
+	assert.Equal(t, []string{"hi"}, collect(msgs, 1))
+}
+
+func TestMemoryQueueGroup(t *testing.T) {
+	hub := NewMemoryHub(MemoryConfig{})
+	pub, _ := serve(t, hub)
+	var members []payloads
+	for i := 0; i < 3; i++ {
+		m, msgs := serve(t, hub)
+		m.QueueSub("foo", "workers")
+		members = append(members, msgs)
+	}
+
+	publishN(pub, "foo", 30)
+	var got []string
+	for _, msgs := range members {
+		some := collect(msgs, 30)
+		assert.NotEmpty(t, some)
+		got = append(got, some...)
+	}
+	assert.Len(t, got, 30)
+}
+
+func TestMemoryLatency(t *testing.T) {
+	hub := NewMemoryHub(MemoryConfig{Latency: 50 * time.Millisecond})
+	a, _ := serve(t, hub)
+	b, msgs := serve(t, hub)
+	b.Sub("foo")
+
+	start := time.Now()
+	a.Pub("foo", []byte("hi"))
+	assert.Equal(t, []string{"hi"}, collect(msgs, 1))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestMemoryLossAndReordering(t *testing.T) {
+	const n = 100
+	run := func(config MemoryConfig) (sent, got []string) {
+		hub := NewMemoryHub(config)
+		a, _ := serve(t, hub)
+		b, msgs := serve(t, hub)
+		b.Sub("foo")
+		return publishN(a, "foo", n), collect(msgs, n)
+	}
+
+	// The same seed loses the same messages.
+	sent, lost := run(MemoryConfig{Loss: 0.5, Seed: 1})
+	assert.Less(t, len(lost), n)
+	assert.NotEmpty(t, lost)
+	assert.Subset(t, sent, lost)
+	_, again := run(MemoryConfig{Loss: 0.5, Seed: 1})
+	assert.Equal(t, lost, again)
+
+	sent, reordered := run(MemoryConfig{Jitter: 20 * time.Millisecond, Seed: 1})
+	assert.ElementsMatch(t, sent, reordered)
+	assert.NotEqual(t, sent, reordered)
+}
+
+func TestMemoryClient(t *testing.T) {
+	hub := NewMemoryHub(MemoryConfig{})
+	sub := psycho.NewServerClient(hub.Attach())
+	defer sub.Close()
+	pub := psycho.NewServerClient(hub.Attach())
+	defer pub.Close()
+
+	conn, err := sub.Dial("foo.*")
+	require.NoError(t, err)
+	require.NoError(t, sub.Flush(context.Background()))
+	require.NoError(t, pub.Publish("foo.bar", []byte("hi")))
+	msg, err := conn.ReceiveMsg()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(msg.Payload))
+}
+
+func TestMemoryConformance(t *testing.T) {
+	hub := NewMemoryHub(MemoryConfig{})
+	servertest.Run(t, func(t *testing.T) psycho.ServerV2 {
+		return hub.Attach().V2()
+	})
+}
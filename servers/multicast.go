@@ -1,7 +1,10 @@
 package servers
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
@@ -9,6 +12,9 @@ import (
 	"time"
 
 	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/internal/closer"
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/subject"
 	"golang.org/x/net/ipv4"
 )
 
@@ -18,27 +24,47 @@ type Multicast struct {
 	groupAddr  *net.UDPAddr
 	bufferSize int
 
-	subscribed map[string]struct{}
+	subscribed *subject.Trie
 	nonces     *seenNonces
 
-	client psycho.Client
+	handler psycho.Handler
+
+	// dec decodes datagrams read by ServeServerOpsTo, one at a time.
+	dec *protocol.ServerDecoder
+
+	closer closer.Closer
 }
 
+// multicastOverhead is the room a datagram needs besides the payload and
+// headers: the preamble, the frame's lengths, the subject and the reply
+// subject.
+const multicastOverhead = 512
+
+// Every datagram starts with multicastMagic and multicastVersion, so that
+// peers tell datagrams they can't read from garbage, and those of another
+// version of the format from either. Then comes a nonce of nonceSize bytes and
+// a PUB op in the binary encoding.
+const (
+	multicastMagic   = 0xb5
+	multicastVersion = 1
+	nonceSize        = 16
+	preambleSize     = 2 + nonceSize
+)
+
 func NewMulticast(group, iface string) (*Multicast, error) {
 	groupAddr, err := net.ResolveUDPAddr("udp4", group)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
-		Port: groupAddr.Port,
-	})
+	ifi, err := net.InterfaceByName(iface)
 	if err != nil {
 		return nil, err
 	}
 
-	ifi, err := net.InterfaceByName(iface)
+	// ListenMulticastUDP joins the group and lets other peers on this host
+	// bind the same port.
+	conn, err := net.ListenMulticastUDP("udp4", ifi, groupAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -46,97 +72,217 @@ func NewMulticast(group, iface string) (*Multicast, error) {
 	packetConn := ipv4.NewPacketConn(conn)
 	packetConn.SetMulticastInterface(ifi)
 	packetConn.SetControlMessage(ipv4.FlagDst, true)
+	// Those peers only hear this one's datagrams over the loopback.
+	packetConn.SetMulticastLoopback(true)
 
-	if err := packetConn.JoinGroup(ifi, groupAddr); err != nil {
-		return nil, err
-	}
-
-	conn.SetReadBuffer(8192)
+	// Room for a burst of datagrams while ServeServerOpsTo catches up, where
+	// the system allows it.
+	conn.SetReadBuffer(1 << 20)
 
-	return &Multicast{
+	m := &Multicast{
 		conn:       conn,
 		packetConn: packetConn,
 		groupAddr:  groupAddr,
 		bufferSize: 8192,
 
-		subscribed: map[string]struct{}{},
+		subscribed: subject.NewTrie(),
 		nonces: &seenNonces{
 			set: map[string]struct{}{},
 			ttl: 10 * time.Second,
 		},
-	}, nil
+	}
+	m.dec = protocol.NewServerDecoder(nil)
+	m.dec.SetMaxPayload(m.MaxPayload())
+	return m, nil
 
 }
 
 func (m *Multicast) Pub(subject string, payload []byte) {
-	nonce := make([]byte, 16)
+	m.PubReply(subject, "", payload)
+}
+
+func (m *Multicast) PubReply(subject, reply string, payload []byte) {
+	m.PubHeader(subject, reply, nil, payload)
+}
+
+func (m *Multicast) PubHeader(subject, reply string, header psycho.Header, payload []byte) {
+	if err := m.pub(subject, reply, header, payload); err != nil {
+		log.Println(err)
+	}
+}
+
+func (m *Multicast) pub(subject, reply string, header psycho.Header, payload []byte) error {
+	preamble := make([]byte, preambleSize)
+	preamble[0], preamble[1] = multicastMagic, multicastVersion
+	nonce := preamble[2:]
 	if _, err := rand.Read(nonce); err != nil {
-		panic(err)
+		return err
 	}
 
-	bts, err := json.Marshal(wireMsg{
-		Subject: subject,
-		Payload: payload,
-		Nonce:   nonce,
-	})
-	if err != nil {
-		panic(err)
+	buf := bytes.NewBuffer(preamble)
+	enc := protocol.NewClientEncoder(buf)
+	enc.SetEncoding(protocol.EncodingBinary)
+	if err := enc.Publish(subject, reply, header, payload); err != nil {
+		return err
+	}
+	bts := buf.Bytes()
+	if len(bts) > m.bufferSize {
+		// Peers would read a truncated datagram.
+		return protocol.ErrPayloadTooLarge{
+			Reason: fmt.Sprintf("message on subject %v needs a %d byte datagram, over %d", subject, len(bts), m.bufferSize),
+		}
 	}
 
 	m.nonces.Seen(string(nonce))
 
-	_, err = m.packetConn.WriteTo(bts, nil, m.groupAddr)
-	if err != nil {
-		panic(err)
-	}
+	_, err := m.packetConn.WriteTo(bts, nil, m.groupAddr)
+	return err
+}
+
+// MaxPayload is the largest payload, headers included, that fits in a datagram
+// peers can read.
+func (m *Multicast) MaxPayload() int {
+	return m.bufferSize - multicastOverhead
 }
 
 func (m *Multicast) Sub(subject string) {
-	m.subscribed[subject] = struct{}{}
+	m.QueueSub(subject, "")
 }
 
 func (m *Multicast) Unsub(subject string) {
-	delete(m.subscribed, subject)
+	m.QueueUnsub(subject, "")
+}
+
+// QueueSub joins a queue group on a best-effort basis. Multicast peers have no
+// way to agree on which of them takes a message, so each peer acts as a
+// single member of the group: every peer with a member receives each message
+// and a ServerCodec on top hands it to one of its own members. A message is
+// thus handled once per peer rather than once per group.
+func (m *Multicast) QueueSub(subject, queue string) {
+	m.subscribed.Insert(subject, multicastSub{subject, queue})
+}
+
+func (m *Multicast) QueueUnsub(subject, queue string) {
+	m.subscribed.Remove(subject, multicastSub{subject, queue})
+}
+
+type multicastSub struct {
+	subject string
+	queue   string
+}
+
+// ServeServerOpsTo delivers messages to handler until m is closed or reading
+// from the network fails.
+func (m *Multicast) ServeServerOpsTo(handler psycho.Handler) {
+	if err := m.serve(handler); err != nil {
+		log.Println(err)
+	}
 }
 
-func (m *Multicast) ServeServerOpsTo(client psycho.Client) {
-	client.HandleInfo(map[string]interface{}{
-		"type":    "multicast",
-		"version": "0.1",
+func (m *Multicast) serve(handler psycho.Handler) error {
+	handler.HandleInfo(map[string]interface{}{
+		"type":        "multicast",
+		"version":     "0.1",
+		"max_payload": m.MaxPayload(),
+		"headers":     true,
 	})
 	buf := make([]byte, m.bufferSize)
 	for {
 		n, cm, _, err := m.packetConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if !cm.Dst.Equal(m.groupAddr.IP) {
+		if cm == nil || !cm.Dst.Equal(m.groupAddr.IP) {
 			continue
 		}
 
-		var msg wireMsg
-		err = json.Unmarshal(buf[:n], &msg)
+		nonce, msg, err := m.decode(buf[:n])
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		if m.nonces.Seen(string(msg.Nonce)) {
+		if m.nonces.Seen(string(nonce)) {
 			continue
 		}
 
-		if _, ok := m.subscribed[msg.Subject]; !ok {
+		if !m.subscribed.HasMatch(msg.Subject) {
 			continue
 		}
 
-		client.HandleMsg(msg.Subject, msg.Payload)
+		psycho.Deliver(handler, msg.Subject, msg.Reply, msg.Header, msg.Payload)
+	}
+}
+
+// Close leaves the multicast group and stops ServeServerOpsTo.
+func (m *Multicast) Close() error {
+	return m.closer.Close(m.packetConn.Close)
+}
+
+// V2 returns m as a psycho.ServerV2, whose ops return the errors that m's
+// own only log.
+func (m *Multicast) V2() psycho.ServerV2 {
+	return multicastV2{m}
+}
+
+type multicastV2 struct {
+	m *Multicast
+}
+
+func (v multicastV2) Pub(ctx context.Context, subject, reply string, header psycho.Header, payload []byte) error {
+	if err := v.m.closer.Check(ctx); err != nil {
+		return err
 	}
+	err := v.m.pub(subject, reply, header, payload)
+	if errors.Is(err, net.ErrClosed) {
+		return psycho.ErrServerClosed{}
+	}
+	return err
 }
 
-type wireMsg struct {
-	Subject string
-	Payload []byte
-	Nonce   []byte
+func (v multicastV2) Sub(ctx context.Context, subject, queue string) error {
+	if err := v.m.closer.Check(ctx); err != nil {
+		return err
+	}
+	v.m.QueueSub(subject, queue)
+	return nil
+}
+
+func (v multicastV2) Unsub(ctx context.Context, subject, queue string) error {
+	if err := v.m.closer.Check(ctx); err != nil {
+		return err
+	}
+	v.m.QueueUnsub(subject, queue)
+	return nil
+}
+
+func (v multicastV2) ServeServerOpsTo(handler psycho.Handler) error {
+	return v.m.serve(handler)
+}
+
+func (v multicastV2) Close() error {
+	return v.m.Close()
+}
+
+func (m *Multicast) decode(datagram []byte) ([]byte, protocol.ClientOperation, error) {
+	if len(datagram) < preambleSize || datagram[0] != multicastMagic {
+		return nil, protocol.ClientOperation{}, errors.New("datagram not sent by a psycho peer")
+	}
+	if datagram[1] != multicastVersion {
+		return nil, protocol.ClientOperation{}, fmt.Errorf("datagram of version %d, want %d", datagram[1], multicastVersion)
+	}
+	m.dec.Reset(bytes.NewReader(datagram[preambleSize:]))
+	op, err := m.dec.ReadOperation()
+	if err != nil {
+		return nil, protocol.ClientOperation{}, err
+	}
+	if op.Type != protocol.TypePublish {
+		return nil, protocol.ClientOperation{}, errors.New("datagram without a PUB op")
+	}
+	return datagram[2:preambleSize], op, nil
 }
 
 type seenNonces struct {
@@ -156,10 +302,9 @@ func (n *seenNonces) Seen(nonce string) bool {
 	n.mu.Lock()
 
 	var i int
-	for i = range n.slice {
-		if n.slice[i].time.After(cutoff) {
-			break
-		}
+	for i < len(n.slice) && !n.slice[i].time.After(cutoff) {
+		delete(n.set, n.slice[i].nonce)
+		i++
 	}
 	n.slice = n.slice[i:]
 
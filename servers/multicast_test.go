@@ -0,0 +1,60 @@
+package servers
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func datagram(t *testing.T, magic, version byte) []byte {
+	buf := bytes.NewBuffer([]byte{magic, version})
+	buf.Write(make([]byte, nonceSize))
+	enc := protocol.NewClientEncoder(buf)
+	enc.SetEncoding(protocol.EncodingBinary)
+	require.NoError(t, enc.Publish("foo", "", nil, []byte("hi")))
+	return buf.Bytes()
+}
+
+func TestMulticastDecode(t *testing.T) {
+	m := &Multicast{dec: protocol.NewServerDecoder(nil)}
+
+	nonce, op, err := m.decode(datagram(t, multicastMagic, multicastVersion))
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, nonceSize), nonce)
+	assert.Equal(t, "foo", op.Subject)
+	assert.Equal(t, "hi", string(op.Payload))
+
+	// Datagrams of another version or from elsewhere are rejected up front.
+	_, _, err = m.decode(datagram(t, multicastMagic, multicastVersion+1))
+	assert.EqualError(t, err, "datagram of version 2, want 1")
+	_, _, err = m.decode(datagram(t, 0, multicastVersion))
+	assert.EqualError(t, err, "datagram not sent by a psycho peer")
+	_, _, err = m.decode([]byte{multicastMagic, multicastVersion})
+	assert.EqualError(t, err, "datagram not sent by a psycho peer")
+}
+
+func TestMulticastPubTooLarge(t *testing.T) {
+	m := &Multicast{bufferSize: 64}
+
+	// The datagram is rejected before it's sent, so m needs no socket.
+	err := m.V2().Pub(context.Background(), "foo", "", nil, make([]byte, 64))
+	assert.IsType(t, protocol.ErrPayloadTooLarge{}, err)
+}
+
+func TestMulticastConformance(t *testing.T) {
+	// Peers on the loopback interface hear each other, and no one else.
+	if _, err := NewMulticast("224.0.0.251:9999", "lo"); err != nil {
+		t.Skipf("no multicast on the loopback interface: %v", err)
+	}
+	servertest.Run(t, func(t *testing.T) psycho.ServerV2 {
+		m, err := NewMulticast("224.0.0.251:9999", "lo")
+		require.NoError(t, err)
+		return m.V2()
+	})
+}
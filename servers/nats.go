@@ -1,14 +1,27 @@
 package servers
 
 import (
+	"context"
+	"log"
+	"sync"
+
 	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/internal/closer"
 	nats "github.com/nats-io/nats.go"
 )
 
 type NATS struct {
-	subs  map[string]*nats.Subscription
+	subs  map[natsSub]*nats.Subscription
 	subCh chan *nats.Msg
 	conn  *nats.Conn
+	mu    sync.Mutex
+
+	closer closer.Closer
+}
+
+type natsSub struct {
+	subject string
+	queue   string
 }
 
 func NewNATS(addr string) (*NATS, error) {
@@ -19,7 +32,7 @@ func NewNATS(addr string) (*NATS, error) {
 
 	return &NATS{
 		conn:  conn,
-		subs:  map[string]*nats.Subscription{},
+		subs:  map[natsSub]*nats.Subscription{},
 		subCh: make(chan *nats.Msg, 64),
 	}, nil
 }
@@ -28,44 +41,168 @@ func (n *NATS) Pub(subject string, payload []byte) {
 	n.conn.Publish(subject, payload)
 }
 
+func (n *NATS) PubReply(subject, reply string, payload []byte) {
+	n.conn.PublishRequest(subject, reply, payload)
+}
+
+// PubHeader publishes with native NATS headers, which need a server of
+// version 2.2 or later.
+func (n *NATS) PubHeader(subject, reply string, header psycho.Header, payload []byte) {
+	n.conn.PublishMsg(&nats.Msg{
+		Subject: subject,
+		Reply:   reply,
+		Header:  nats.Header(header),
+		Data:    payload,
+	})
+}
+
 func (n *NATS) Sub(subject string) {
-	if _, ok := n.subs[subject]; ok {
-		return
+	n.QueueSub(subject, "")
+}
+
+// QueueSub subscribes with a NATS queue subscription, so that of all the NATS
+// clients in the group only one receives each message.
+func (n *NATS) QueueSub(subject, queue string) {
+	if err := n.queueSub(subject, queue); err != nil {
+		log.Printf("subscribing to %v: %v", subject, err)
+	}
+}
+
+func (n *NATS) queueSub(subject, queue string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := natsSub{subject, queue}
+	if _, ok := n.subs[key]; ok {
+		return nil
 	}
 
-	sub, err := n.conn.ChanSubscribe(subject, n.subCh)
+	var sub *nats.Subscription
+	var err error
+	if queue == "" {
+		sub, err = n.conn.ChanSubscribe(subject, n.subCh)
+	} else {
+		sub, err = n.conn.ChanQueueSubscribe(subject, queue, n.subCh)
+	}
 	if err != nil {
-		// TODO: notify client via some new logging type messages
-		return
+		return err
 	}
 
-	n.subs[subject] = sub
-
-	return
+	n.subs[key] = sub
+	return nil
 }
 
 func (n *NATS) Unsub(subject string) {
-	sub, ok := n.subs[subject]
-	if !ok {
-		return
+	n.QueueUnsub(subject, "")
+}
+
+func (n *NATS) QueueUnsub(subject, queue string) {
+	if err := n.queueUnsub(subject, queue); err != nil {
+		log.Printf("unsubscribing from %v: %v", subject, err)
 	}
+}
 
-	sub.Unsubscribe()
-	delete(n.subs, subject)
+func (n *NATS) queueUnsub(subject, queue string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := natsSub{subject, queue}
+	sub, ok := n.subs[key]
+	if !ok {
+		return nil
+	}
 
-	return
+	delete(n.subs, key)
+	return sub.Unsubscribe()
 }
 
-func (n *NATS) ServeServerOpsTo(client psycho.Client) {
-	client.HandleInfo(map[string]interface{}{
-		"type":    "nats",
-		"version": "0.1",
+// ServeServerOpsTo delivers messages to handler until n is closed.
+func (n *NATS) ServeServerOpsTo(handler psycho.Handler) {
+	handler.HandleInfo(map[string]interface{}{
+		"type":        "nats",
+		"version":     "0.1",
+		"max_payload": int(n.conn.MaxPayload()),
+		"headers":     n.conn.HeadersSupported(),
 	})
-	for msg := range n.subCh {
-		client.HandleMsg(msg.Subject, msg.Data)
+	for {
+		select {
+		case msg := <-n.subCh:
+			// NATS delivers a copy for every subscription a message matches.
+			psycho.DeliverSub(handler, msg.Sub.Subject, msg.Sub.Queue, msg.Subject, msg.Reply, psycho.Header(msg.Header), msg.Data)
+		case <-n.closer.Closing():
+			return
+		}
 	}
 }
 
 func (n *NATS) Close() {
-	n.conn.Close()
+	n.close()
+}
+
+func (n *NATS) close() error {
+	return n.closer.Close(func() error {
+		n.conn.Close()
+		return nil
+	})
+}
+
+// V2 returns n as a psycho.ServerV2, whose ops return the errors that n's own
+// drop or only log. Its Sub and Unsub return once the NATS server has taken
+// them in.
+func (n *NATS) V2() psycho.ServerV2 {
+	return natsV2{n}
+}
+
+type natsV2 struct {
+	n *NATS
+}
+
+func (v natsV2) Pub(ctx context.Context, subject, reply string, header psycho.Header, payload []byte) error {
+	if err := v.n.closer.Check(ctx); err != nil {
+		return err
+	}
+	return v.n.conn.PublishMsg(&nats.Msg{
+		Subject: subject,
+		Reply:   reply,
+		Header:  nats.Header(header),
+		Data:    payload,
+	})
+}
+
+func (v natsV2) Sub(ctx context.Context, subject, queue string) error {
+	if err := v.n.closer.Check(ctx); err != nil {
+		return err
+	}
+	if err := v.n.queueSub(subject, queue); err != nil {
+		return err
+	}
+	return v.flush(ctx)
+}
+
+func (v natsV2) Unsub(ctx context.Context, subject, queue string) error {
+	if err := v.n.closer.Check(ctx); err != nil {
+		return err
+	}
+	if err := v.n.queueUnsub(subject, queue); err != nil {
+		return err
+	}
+	return v.flush(ctx)
+}
+
+// flush waits for the NATS server to take in the ops sent so far, until ctx
+// is done, or for nats.DefaultTimeout if ctx has no deadline.
+func (v natsV2) flush(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.DefaultTimeout)
+		defer cancel()
+	}
+	return v.n.conn.FlushWithContext(ctx)
+}
+
+func (v natsV2) ServeServerOpsTo(handler psycho.Handler) error {
+	v.n.ServeServerOpsTo(handler)
+	return nil
+}
+
+func (v natsV2) Close() error {
+	return v.n.close()
 }
@@ -0,0 +1,37 @@
+package servers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/servertest"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+// runNATS runs a NATS server until the end of the test, and returns a
+// function that connects a new NATS to it.
+func runNATS(t *testing.T) func(t *testing.T) psycho.ServerV2 {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+
+	return func(t *testing.T) psycho.ServerV2 {
+		n, err := NewNATS(s.ClientURL())
+		require.NoError(t, err)
+		return n.V2()
+	}
+}
+
+func TestNATSConformance(t *testing.T) {
+	servertest.Run(t, runNATS(t))
+}
+
+func TestNATSSubWithoutDeadline(t *testing.T) {
+	n := runNATS(t)(t)
+	defer n.Close()
+	require.NoError(t, n.Sub(context.Background(), "foo", ""))
+	require.NoError(t, n.Unsub(context.Background(), "foo", ""))
+}
@@ -0,0 +1,162 @@
+package servers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/internal/closer"
+)
+
+// Remote is a psycho.ServerV2 that relays over a psycho.Client to a server
+// elsewhere, such as TinyServer or the stdio command of another process.
+// Whether a client's own messages come back depends on that server; connect
+// with psycho.NoEcho for one that doesn't send them.
+type Remote struct {
+	client *psycho.Client
+
+	// conns are the subscriptions made, by subject and queue group.
+	conns map[remoteSub]*psycho.Conn
+	mu    sync.Mutex
+
+	// msgs passes the messages received on conns to ServeServerOpsTo, and
+	// failed the error that ended one of them other than closing it.
+	msgs   chan remoteMsg
+	failed chan error
+
+	closer closer.Closer
+}
+
+type remoteSub struct {
+	subject string
+	queue   string
+}
+
+type remoteMsg struct {
+	sub remoteSub
+	msg *psycho.Msg
+}
+
+// NewRemote returns a Remote over client, which it closes when closed.
+func NewRemote(client *psycho.Client) *Remote {
+	return &Remote{
+		client: client,
+		conns:  map[remoteSub]*psycho.Conn{},
+		msgs:   make(chan remoteMsg, 64),
+		failed: make(chan error, 1),
+	}
+}
+
+func (r *Remote) Pub(ctx context.Context, subject, reply string, header psycho.Header, payload []byte) error {
+	if err := r.closer.Check(ctx); err != nil {
+		return err
+	}
+	return r.client.PublishMsg(&psycho.Msg{Subject: subject, Reply: reply, Header: header, Payload: payload})
+}
+
+// Sub subscribes, and returns once the server has the subscription.
+func (r *Remote) Sub(ctx context.Context, subject, queue string) error {
+	if err := r.closer.Check(ctx); err != nil {
+		return err
+	}
+	key := remoteSub{subject, queue}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.conns[key]; ok {
+		return nil
+	}
+	var conn *psycho.Conn
+	var err error
+	if queue == "" {
+		conn, err = r.client.DialContext(ctx, subject)
+	} else {
+		conn, err = r.client.DialQueue(subject, queue)
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.client.Flush(ctx); err != nil {
+		conn.Close()
+		return err
+	}
+	r.conns[key] = conn
+	go r.receive(key, conn)
+	return nil
+}
+
+// Unsub unsubscribes, and returns once the server has dropped the
+// subscription.
+func (r *Remote) Unsub(ctx context.Context, subject, queue string) error {
+	if err := r.closer.Check(ctx); err != nil {
+		return err
+	}
+	key := remoteSub{subject, queue}
+	r.mu.Lock()
+	conn, ok := r.conns[key]
+	delete(r.conns, key)
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	conn.Close()
+	return r.client.Flush(ctx)
+}
+
+// receive passes on the messages conn receives until it's closed.
+func (r *Remote) receive(key remoteSub, conn *psycho.Conn) {
+	for {
+		msg, err := conn.ReceiveMsg()
+		if _, closed := err.(psycho.ErrConnClosed); closed {
+			return
+		}
+		if err != nil {
+			select {
+			case r.failed <- err:
+			default:
+			}
+			return
+		}
+		select {
+		case r.msgs <- remoteMsg{key, msg}:
+		case <-r.closer.Closing():
+			return
+		}
+	}
+}
+
+// ServeServerOpsTo passes on the server's INFO and messages to handler until
+// r is closed or the client fails.
+func (r *Remote) ServeServerOpsTo(handler psycho.Handler) error {
+	info, err := r.client.Info()
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	for k, v := range info {
+		values[k] = v
+	}
+	// Handlers such as ServerCodec take max_payload as a number, and
+	// headers as a bool.
+	if n, err := strconv.Atoi(info["max_payload"]); err == nil {
+		values["max_payload"] = n
+	}
+	if headers, err := strconv.ParseBool(info["headers"]); err == nil {
+		values["headers"] = headers
+	}
+	handler.HandleInfo(values)
+	for {
+		select {
+		case m := <-r.msgs:
+			psycho.DeliverSub(handler, m.sub.subject, m.sub.queue, m.msg.Subject, m.msg.Reply, m.msg.Header, m.msg.Payload)
+		case err := <-r.failed:
+			return err
+		case <-r.closer.Closing():
+			return nil
+		}
+	}
+}
+
+func (r *Remote) Close() error {
+	return r.closer.Close(r.client.Close)
+}
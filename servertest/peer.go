@@ -0,0 +1,133 @@
+package servertest
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/stretchr/testify/require"
+)
+
+// peer is a server under test along with what it delivers.
+type peer struct {
+	psycho.ServerV2
+
+	// events are the INFO and the messages the server delivered, in order,
+	// and served is passed the error ServeServerOpsTo returns.
+	events chan event
+	served chan error
+	info   map[string]interface{}
+}
+
+// event is an INFO or a message.
+type event struct {
+	info map[string]interface{}
+	msg  *psycho.Msg
+}
+
+func (p *peer) HandleInfo(info map[string]interface{}) {
+	p.events <- event{info: info}
+}
+
+func (p *peer) HandleMsg(subj string, payload []byte) {
+	p.HandleHeaderMsg(subj, "", nil, payload)
+}
+
+func (p *peer) HandleHeaderMsg(subj, reply string, header psycho.Header, payload []byte) {
+	// Servers may reuse payload once this returns.
+	payload = append([]byte(nil), payload...)
+	p.events <- event{msg: &psycho.Msg{Subject: subj, Reply: reply, Header: header, Payload: payload}}
+}
+
+// peer returns a new server that isn't served yet.
+func (s *suite) peer(t *testing.T) *peer {
+	p := &peer{
+		ServerV2: s.newServer(t),
+		events:   make(chan event, 1000),
+		served:   make(chan error, 1),
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// start returns a new server, served once its INFO is in.
+func (s *suite) start(t *testing.T) *peer {
+	p := s.peer(t)
+	p.serve()
+	e := p.next(t)
+	require.NotNil(t, e.info, "got a message before INFO")
+	p.info = e.info
+	return p
+}
+
+func (p *peer) serve() {
+	go func() { p.served <- p.ServeServerOpsTo(p) }()
+}
+
+// next returns the next event.
+func (p *peer) next(t *testing.T) event {
+	select {
+	case e := <-p.events:
+		return e
+	case <-time.After(timeout):
+		t.Fatal("nothing delivered")
+		return event{}
+	}
+}
+
+// expect returns the next message.
+func (p *peer) expect(t *testing.T) *psycho.Msg {
+	e := p.next(t)
+	require.NotNil(t, e.msg, "got another INFO")
+	return e.msg
+}
+
+// receiveUntil returns the payloads of the messages delivered up to one with
+// payload last.
+func (p *peer) receiveUntil(t *testing.T, last string) []string {
+	var payloads []string
+	for {
+		payload := string(p.expect(t).Payload)
+		payloads = append(payloads, payload)
+		if payload == last {
+			return payloads
+		}
+	}
+}
+
+// expectNone checks that no more messages are delivered for a while, for
+// those that would arrive out of order.
+func (p *peer) expectNone(t *testing.T) {
+	select {
+	case e := <-p.events:
+		t.Errorf("unexpected delivery %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// ctx returns a context for an op, which fails the test if it takes too long.
+func ctx(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// maxPayload returns the max_payload in info, which may be a number or a
+// string of one.
+func maxPayload(info map[string]interface{}) int {
+	switch n := info["max_payload"].(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	case string:
+		if n, err := strconv.Atoi(n); err == nil {
+			return n
+		}
+	}
+	return psycho.DefaultMaxPayload
+}
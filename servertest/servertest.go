@@ -0,0 +1,249 @@
+// Package servertest checks that a psycho.ServerV2 behaves like the others,
+// so that apps can swap one network for another.
+//
+// Run it from a test of the server, with a function that returns a new
+// server on the network under test for every call:
+//
+//	func TestConformance(t *testing.T) {
+//		hub := servers.NewMemoryHub(servers.MemoryConfig{})
+//		servertest.Run(t, func(t *testing.T) psycho.ServerV2 {
+//			return hub.Attach().V2()
+//		})
+//	}
+//
+// Servers written against psycho.Server can be checked through
+// psycho.AdaptServer, as long as they can be closed.
+package servertest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewServer returns a new server for one client, on a network that the
+// other servers it returns are on too. Servers are closed at the end of the
+// test they're made for.
+type NewServer func(t *testing.T) psycho.ServerV2
+
+// timeout is how long to wait for a message that should arrive.
+const timeout = 5 * time.Second
+
+// maxLarge caps the payload of the large payload test, for servers that
+// accept any size.
+const maxLarge = 1 << 20
+
+// Run checks, in subtests of t, that the servers newServer returns
+//
+//   - deliver INFO before any message,
+//   - don't deliver a client's own messages back to it,
+//   - deliver messages published after Sub returns,
+//   - deliver none published after Unsub returns,
+//   - take a second Sub of the same subject as a no-op,
+//   - carry payloads up to the max_payload in their INFO,
+//   - can be used from many goroutines at once and
+//   - stop serving when closed, failing ops after that with
+//     psycho.ErrServerClosed.
+//
+// Messages from one server to another are expected to arrive in the order
+// they were published.
+func Run(t *testing.T, newServer NewServer) {
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
+	s := &suite{
+		newServer: newServer,
+		// Other runs may share the network.
+		prefix: "servertest." + hex.EncodeToString(prefix),
+	}
+	t.Run("InfoFirst", s.testInfoFirst)
+	t.Run("NoEcho", s.testNoEcho)
+	t.Run("DeliveryAfterSub", s.testDeliveryAfterSub)
+	t.Run("NoneAfterUnsub", s.testNoneAfterUnsub)
+	t.Run("DuplicateSub", s.testDuplicateSub)
+	t.Run("LargePayload", s.testLargePayload)
+	t.Run("Concurrent", s.testConcurrent)
+	t.Run("Shutdown", s.testShutdown)
+}
+
+type suite struct {
+	newServer NewServer
+	prefix    string
+}
+
+// subject returns a subject of the test t that no other test uses.
+func (s *suite) subject(t *testing.T, name string) string {
+	return s.prefix + "." + path.Base(t.Name()) + "." + name
+}
+
+func (s *suite) testInfoFirst(t *testing.T) {
+	subj := s.subject(t, "foo")
+	a := s.start(t)
+	b := s.peer(t)
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+	// Whatever arrives, INFO comes before it.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("hi")))
+	}
+	b.serve()
+	e := b.next(t)
+	assert.NotNil(t, e.info, "got a message before INFO")
+}
+
+func (s *suite) testNoEcho(t *testing.T) {
+	subj := s.subject(t, "foo")
+	a, b := s.start(t), s.start(t)
+	require.NoError(t, a.Sub(ctx(t), subj, ""))
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("from a")))
+	b.receiveUntil(t, "from a")
+	require.NoError(t, b.Pub(ctx(t), subj, "", nil, []byte("from b")))
+	assert.Equal(t, []string{"from b"}, a.receiveUntil(t, "from b"))
+}
+
+func (s *suite) testDeliveryAfterSub(t *testing.T) {
+	a, b := s.start(t), s.start(t)
+
+	subj := s.subject(t, "foo")
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("hi")))
+	msg := b.expect(t)
+	assert.Equal(t, subj, msg.Subject)
+	assert.Equal(t, "hi", string(msg.Payload))
+
+	wildcard := s.subject(t, "bar")
+	require.NoError(t, b.Sub(ctx(t), wildcard+".*", ""))
+	require.NoError(t, a.Pub(ctx(t), wildcard+".baz", "", nil, []byte("hi")))
+	msg = b.expect(t)
+	assert.Equal(t, wildcard+".baz", msg.Subject)
+	assert.Equal(t, "hi", string(msg.Payload))
+}
+
+func (s *suite) testNoneAfterUnsub(t *testing.T) {
+	subj, marker := s.subject(t, "foo"), s.subject(t, "marker")
+	a, b := s.start(t), s.start(t)
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+	require.NoError(t, b.Sub(ctx(t), marker, ""))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("before")))
+	b.receiveUntil(t, "before")
+
+	require.NoError(t, b.Unsub(ctx(t), subj, ""))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("after")))
+	require.NoError(t, a.Pub(ctx(t), marker, "", nil, []byte("sync")))
+	assert.Equal(t, []string{"sync"}, b.receiveUntil(t, "sync"))
+	b.expectNone(t)
+}
+
+func (s *suite) testDuplicateSub(t *testing.T) {
+	subj, marker := s.subject(t, "foo"), s.subject(t, "marker")
+	a, b := s.start(t), s.start(t)
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("1")))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("2")))
+	assert.Equal(t, []string{"1", "2"}, b.receiveUntil(t, "2"))
+
+	// One Unsub undoes both.
+	require.NoError(t, b.Unsub(ctx(t), subj, ""))
+	require.NoError(t, b.Sub(ctx(t), marker, ""))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, []byte("3")))
+	require.NoError(t, a.Pub(ctx(t), marker, "", nil, []byte("sync")))
+	assert.Equal(t, []string{"sync"}, b.receiveUntil(t, "sync"))
+	b.expectNone(t)
+}
+
+func (s *suite) testLargePayload(t *testing.T) {
+	subj := s.subject(t, "foo")
+	a, b := s.start(t), s.start(t)
+	size := maxPayload(a.info)
+	if size > maxLarge {
+		size = maxLarge
+	}
+	payload := make([]byte, size)
+	rand.Read(payload)
+
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+	require.NoError(t, a.Pub(ctx(t), subj, "", nil, payload))
+	msg := b.expect(t)
+	assert.Equal(t, payload, msg.Payload)
+}
+
+func (s *suite) testConcurrent(t *testing.T) {
+	const publishers, perPublisher = 4, 10
+	subj := s.subject(t, "foo")
+	a, b, c := s.start(t), s.start(t), s.start(t)
+	require.NoError(t, c.Sub(ctx(t), subj, ""))
+
+	var wg sync.WaitGroup
+	sent := map[string]bool{}
+	for i := 0; i < publishers; i++ {
+		pub := a
+		if i%2 == 1 {
+			pub = b
+		}
+		for j := 0; j < perPublisher; j++ {
+			sent[fmt.Sprintf("%d-%d", i, j)] = true
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perPublisher; j++ {
+				assert.NoError(t, pub.Pub(ctx(t), subj, "", nil, []byte(fmt.Sprintf("%d-%d", i, j))))
+			}
+		}(i)
+	}
+	// Subscriptions come and go meanwhile, on the subscriber and publishers.
+	for _, p := range []*peer{a, b, c} {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			for j := 0; j < perPublisher; j++ {
+				other := s.subject(t, "other"+strconv.Itoa(j))
+				assert.NoError(t, p.Sub(ctx(t), other, ""))
+				assert.NoError(t, p.Unsub(ctx(t), other, ""))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	got := map[string]bool{}
+	for len(got) < len(sent) {
+		msg := c.expect(t)
+		payload := string(msg.Payload)
+		require.True(t, sent[payload], "unexpected message %q", payload)
+		require.False(t, got[payload], "message %q delivered twice", payload)
+		got[payload] = true
+	}
+}
+
+func (s *suite) testShutdown(t *testing.T) {
+	subj := s.subject(t, "foo")
+	a, b := s.start(t), s.start(t)
+	require.NoError(t, b.Sub(ctx(t), subj, ""))
+
+	require.NoError(t, a.Close())
+	select {
+	case err := <-a.served:
+		assert.NoError(t, err)
+	case <-time.After(timeout):
+		t.Fatal("ServeServerOpsTo didn't return after Close")
+	}
+	assert.Equal(t, psycho.ErrServerClosed{}, a.Pub(ctx(t), subj, "", nil, nil))
+	assert.Equal(t, psycho.ErrServerClosed{}, a.Sub(ctx(t), subj, ""))
+	assert.Equal(t, psycho.ErrServerClosed{}, a.Unsub(ctx(t), subj, ""))
+	assert.Equal(t, psycho.ErrServerClosed{}, a.Close())
+
+	// The others carry on.
+	c := s.start(t)
+	require.NoError(t, c.Pub(ctx(t), subj, "", nil, []byte("hi")))
+	assert.Equal(t, "hi", string(b.expect(t).Payload))
+}
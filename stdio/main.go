@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/olekukonko/tablewriter"
 
 	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/middleware"
 	"github.com/Gaboose/psycho/servers"
 )
 
@@ -70,6 +74,43 @@ func printInterfaceInfo(verbose bool) {
 	table.Render() // Send output
 }
 
+func logMetrics(metrics *middleware.Metrics, interval time.Duration) {
+	for range time.Tick(interval) {
+		for subj, m := range metrics.Subjects() {
+			log.Printf("%s: published %d (%d bytes), delivered %d (%d bytes)",
+				subj, m.Published, m.PublishedBytes, m.Delivered, m.DeliveredBytes)
+		}
+	}
+}
+
+// subjects splits a comma separated list of subjects.
+func subjects(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// bridge forwards messages between a and b until interrupted.
+func bridge(a, b psycho.ServerV2, config servers.BridgeConfig) {
+	br, err := servers.NewBridge(context.Background(), a, b, config)
+	if err != nil {
+		a.Close()
+		b.Close()
+		log.Println(err)
+		return
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		br.Close()
+	}()
+	if err := br.Serve(); err != nil {
+		log.Println(err)
+	}
+}
+
 func main() {
 
 	natsBool := flag.Bool("n", true, "over nats")
@@ -77,6 +118,14 @@ func main() {
 	natsAddr := flag.String("na", "demo.nats.io:4222", "nats server address")
 	multicastAddr := flag.String("ma", "224.0.0.1:9999", "multicast group")
 	multicastInterface := flag.String("mi", "wlp3s0", "multicast interface")
+	token := flag.String("token", "", "token the client must CONNECT with")
+	logOps := flag.Bool("log", false, "log ops and messages to stderr")
+	metricsInterval := flag.Duration("metrics", 0, "log message counts by subject at this interval")
+	deny := flag.String("deny", "", "comma separated subjects the client can't use")
+	gzipBool := flag.Bool("gzip", false, "gzip payloads on the network")
+	bridgeBool := flag.Bool("bridge", false, "bridge multicast and nats instead of serving a client")
+	multicastToNATS := flag.String("m2n", ">", "comma separated subjects the bridge forwards from multicast to nats")
+	natsToMulticast := flag.String("n2m", ">", "comma separated subjects the bridge forwards from nats to multicast")
 
 	infoInterfacesBool := flag.Bool("info", false, "print network interface information")
 	verbose := flag.Bool("v", false, "verbose")
@@ -87,25 +136,80 @@ func main() {
 		return
 	}
 
-	var server psycho.Server
-	var err error
+	if *bridgeBool {
+		m, err := servers.NewMulticast(*multicastAddr, *multicastInterface)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		n, err := servers.NewNATS(*natsAddr)
+		if err != nil {
+			m.Close()
+			log.Println(err)
+			return
+		}
+		bridge(m.V2(), n.V2(), servers.BridgeConfig{
+			AToB: subjects(*multicastToNATS),
+			BToA: subjects(*natsToMulticast),
+		})
+		return
+	}
+
+	var server psycho.ServerV2
 
 	switch {
 	case *multicastBool:
-		server, err = servers.NewMulticast(*multicastAddr, *multicastInterface)
+		m, err := servers.NewMulticast(*multicastAddr, *multicastInterface)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		server = m.V2()
 	case *natsBool:
-		server, err = servers.NewNATS(*natsAddr)
+		n, err := servers.NewNATS(*natsAddr)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		server = n.V2()
 	default:
 		flag.Usage()
 		return
 	}
-	if err != nil {
-		log.Println(err)
-		return
+
+	// Logging goes first to see the ops as the client sent them, and gzip
+	// last for the others to see payloads uncompressed.
+	var middlewares []psycho.Middleware
+	if *logOps {
+		middlewares = append(middlewares, middleware.Logging(log.Default()))
+	}
+	if *deny != "" {
+		middlewares = append(middlewares, middleware.Filter(subjects(*deny)...))
 	}
+	if *metricsInterval > 0 {
+		metrics := middleware.NewMetrics()
+		middlewares = append(middlewares, metrics.Middleware())
+		go logMetrics(metrics, *metricsInterval)
+	}
+	if *gzipBool {
+		middlewares = append(middlewares, middleware.Gzip())
+	}
+	server = psycho.Chain(server, middlewares...)
+	defer server.Close()
 
 	codec := psycho.NewServerCodec(os.Stdin, os.Stdout)
+	if *token != "" {
+		codec.RequireAuth(func(opts *psycho.ConnectOptions) bool {
+			return opts.Authorized(*token, nil)
+		})
+	}
 
-	go codec.ServeClientOpsTo(server)
-	server.ServeServerOpsTo(codec)
+	// The client is gone once ServeClientOpsToV2 returns, whether it closed
+	// stdin or was turned away, so that's when to exit.
+	go func() {
+		if err := server.ServeServerOpsTo(codec); err != nil {
+			log.Println(err)
+		}
+	}()
+	codec.ServeClientOpsToV2(context.Background(), server)
 }
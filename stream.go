@@ -0,0 +1,366 @@
+package psycho
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStreamGap is returned from a Stream's Read once a message of the peer's
+// went missing, after which the byte stream can't be put back together.
+type ErrStreamGap struct{}
+
+func (e ErrStreamGap) Error() string { return "psycho: messages missing from the stream" }
+
+// The messages of a stream start with one of these bytes.
+const (
+	// streamData is followed by the message's sequence number as a uvarint,
+	// counting from 1, and the data.
+	streamData byte = iota
+	// streamAck is followed by the number of data messages read so far, as
+	// a uvarint.
+	streamAck
+	// streamFin ends the stream.
+	streamFin
+)
+
+const (
+	// streamWindow is how many data messages a Stream sends ahead of the
+	// peer's acknowledgements. The peer acknowledges every half a window.
+	streamWindow = 64
+	// streamChunk is the most data a Stream sends in a message, unless the
+	// server's max_payload is lower.
+	streamChunk = 16 << 10
+)
+
+// Stream is a byte stream over a pair of subjects: it receives on a Conn and
+// writes to the peer's subject, in messages of up to 16 KiB. It implements
+// net.Conn, so that io.Copy, bufio or crypto/tls can run over psycho.
+//
+// A Stream only sends so many messages ahead of what the peer has read,
+// which bounds how much it buffers, but it doesn't resend lost ones. If a
+// message goes missing, as it can over servers that drop messages for slow
+// consumers, Read returns ErrStreamGap. Deadlines apply to waiting for the
+// peer, and not to handing messages to the client.
+type Stream struct {
+	conn *Conn
+	peer string
+
+	// data passes the payloads of data messages from demux to Read, and
+	// a nil one for a gap. It's closed after the peer's FIN, or with recvErr
+	// if receiving failed.
+	data    chan []byte
+	recvErr error
+	readBuf []byte
+	gap     bool
+	// read counts the data messages read, and readAcked those of them
+	// acknowledged.
+	read, readAcked uint64
+	readMu          sync.Mutex
+
+	// sent counts the data messages sent, and acked those the peer has
+	// acknowledged. acks is signalled whenever acked grows.
+	sent, acked uint64
+	acks        chan struct{}
+	ackMu       sync.Mutex
+	writeMu     sync.Mutex
+
+	readDeadline, writeDeadline *deadline
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// DialStream subscribes to local and returns a Stream that receives on it and
+// writes to peer, for a peer that does the same the other way around.
+func (c *Client) DialStream(local, peer string) (*Stream, error) {
+	conn, err := c.Dial(local, RecvBuffer(2*streamWindow), SlowConsumer(BlockReader))
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(conn, peer), nil
+}
+
+// NewStream returns a Stream that receives on conn and writes to peer. The
+// Stream takes over conn, which should buffer twice as many messages as a
+// Stream sends ahead and block the reader when full, as in DialStream, so
+// that none are dropped on the way in.
+func NewStream(conn *Conn, peer string) *Stream {
+	s := &Stream{
+		conn:          conn,
+		peer:          peer,
+		data:          make(chan []byte, streamWindow),
+		acks:          make(chan struct{}, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closing:       make(chan struct{}),
+	}
+	go s.demux()
+	return s
+}
+
+// demux reads the Stream's messages, passing on data to Read and taking
+// note of acknowledgements for Write.
+func (s *Stream) demux() {
+	defer close(s.data)
+	var seq uint64
+	for {
+		msg, err := s.conn.ReceiveMsg()
+		if err != nil {
+			s.recvErr = err
+			return
+		}
+		if len(msg.Payload) == 0 {
+			continue
+		}
+		body := msg.Payload[1:]
+		switch msg.Payload[0] {
+		case streamData:
+			n, k := binary.Uvarint(body)
+			if k <= 0 || n != seq+1 {
+				body, k = nil, 0
+			}
+			seq = n
+			select {
+			case s.data <- body[k:]:
+			case <-s.closing:
+				return
+			}
+			if body == nil {
+				return
+			}
+		case streamAck:
+			n, k := binary.Uvarint(body)
+			if k <= 0 {
+				continue
+			}
+			s.ackMu.Lock()
+			if n > s.acked {
+				s.acked = n
+			}
+			s.ackMu.Unlock()
+			select {
+			case s.acks <- struct{}{}:
+			default:
+			}
+		case streamFin:
+			return
+		}
+	}
+}
+
+// Read reads data the peer wrote. It returns io.EOF once the peer has closed
+// the Stream and all of its data has been read.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if err := s.check(s.readDeadline); err != nil {
+		return 0, err
+	}
+	if s.gap {
+		return 0, ErrStreamGap{}
+	}
+	for len(s.readBuf) == 0 {
+		select {
+		case data, ok := <-s.data:
+			if !ok && s.recvErr != nil {
+				return 0, s.recvErr
+			}
+			if !ok {
+				return 0, io.EOF
+			}
+			if data == nil {
+				s.gap = true
+				return 0, ErrStreamGap{}
+			}
+			s.readBuf = data
+			s.read++
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-s.closing:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	if len(s.readBuf) == 0 && s.read-s.readAcked >= streamWindow/2 {
+		s.readAcked = s.read
+		s.conn.client.Publish(s.peer, appendUvarint([]byte{streamAck}, s.read))
+	}
+	return n, nil
+}
+
+// Write writes b to the peer in as many messages as it takes, waiting for
+// the peer to read earlier ones if too many are unread.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.check(s.writeDeadline); err != nil {
+		return 0, err
+	}
+	chunk := streamChunk
+	if max := int(atomic.LoadInt64(&s.conn.client.maxPayload)) - binary.MaxVarintLen64 - 1; max > 0 && max < chunk {
+		chunk = max
+	}
+	var written int
+	for len(b) > 0 {
+		if err := s.waitForWindow(); err != nil {
+			return written, err
+		}
+		n := len(b)
+		if n > chunk {
+			n = chunk
+		}
+		s.sent++
+		payload := append(appendUvarint([]byte{streamData}, s.sent), b[:n]...)
+		if err := s.conn.client.Publish(s.peer, payload); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// waitForWindow waits until fewer than streamWindow messages are
+// unacknowledged.
+func (s *Stream) waitForWindow() error {
+	for {
+		s.ackMu.Lock()
+		unacked := s.sent - s.acked
+		s.ackMu.Unlock()
+		if unacked < streamWindow {
+			return nil
+		}
+		select {
+		case <-s.acks:
+		case <-s.writeDeadline.wait():
+			return os.ErrDeadlineExceeded
+		case <-s.closing:
+			return net.ErrClosed
+		}
+	}
+}
+
+// check returns the error for a Read or Write on a closed Stream or past
+// its deadline.
+func (s *Stream) check(d *deadline) error {
+	select {
+	case <-s.closing:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case <-d.wait():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	return nil
+}
+
+// Close tells the peer the Stream has ended, after the data written so far,
+// closes the Conn and unblocks pending Reads and Writes.
+func (s *Stream) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		err = s.conn.client.Publish(s.peer, []byte{streamFin})
+		s.conn.Close()
+	})
+	return err
+}
+
+// LocalAddr returns the subject the Stream receives on.
+func (s *Stream) LocalAddr() net.Addr { return Addr(s.conn.subject) }
+
+// RemoteAddr returns the subject the Stream writes to.
+func (s *Stream) RemoteAddr() net.Addr { return Addr(s.peer) }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// Addr is a subject as a net.Addr.
+type Addr string
+
+func (a Addr) Network() string { return "psycho" }
+func (a Addr) String() string  { return string(a) }
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+// deadline is a channel that's closed once a time set with set passes.
+// Setting another time affects those already waiting.
+type deadline struct {
+	timer   *time.Timer
+	expired chan struct{}
+	mu      sync.Mutex
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+// set sets the deadline to t, or none if t is zero.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, and closes expired if it hasn't yet.
+		<-d.expired
+	}
+	d.timer = nil
+
+	expired := isClosed(d.expired)
+	if t.IsZero() {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		ch := d.expired
+		d.timer = time.AfterFunc(dur, func() { close(ch) })
+		return
+	}
+	if !expired {
+		close(d.expired)
+	}
+}
+
+// wait returns a channel that's closed once the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
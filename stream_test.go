@@ -0,0 +1,52 @@
+package psycho
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+func TestStreamConn(t *testing.T) {
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		c := NewServerClient(&fakeServer{})
+		a, err := c.DialStream("a", "b")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		b, err := c.DialStream("b", "a")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stop := func() {
+			a.Close()
+			b.Close()
+			c.Close()
+		}
+		return a, b, stop, nil
+	})
+}
+
+func TestStreamGap(t *testing.T) {
+	c := NewServerClient(&fakeServer{})
+	defer c.Close()
+	s, err := c.DialStream("a", "b")
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, c.Flush(context.Background()))
+
+	// The peer's second message went missing.
+	require.NoError(t, c.Publish("a", append(appendUvarint([]byte{streamData}, 1), "one"...)))
+	require.NoError(t, c.Publish("a", append(appendUvarint([]byte{streamData}, 3), "three"...)))
+	buf := make([]byte, 10)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(buf[:n]))
+	_, err = s.Read(buf)
+	assert.Equal(t, ErrStreamGap{}, err)
+	_, err = s.Read(buf)
+	assert.Equal(t, ErrStreamGap{}, err)
+}
@@ -0,0 +1,227 @@
+// Package subject implements NATS-style dot-separated subjects and a trie
+// for matching them against wildcard patterns.
+//
+// A subject is a sequence of non-empty tokens separated by dots, for example
+// "chat.room1.alice". A pattern may also contain the wildcards "*", which
+// matches exactly one token, and ">", which matches one or more tokens and is
+// only allowed as the last token.
+package subject
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	sep  = "."
+	pwc  = "*"
+	fwc  = ">"
+	tsep = '.'
+)
+
+// ValidSubject reports whether s is a literal subject that can be published
+// to, i.e. one without wildcards.
+func ValidSubject(s string) bool {
+	return valid(s, false)
+}
+
+// ValidPattern reports whether s can be subscribed to. Every literal subject
+// is a valid pattern.
+func ValidPattern(s string) bool {
+	return valid(s, true)
+}
+
+func valid(s string, wildcards bool) bool {
+	if s == "" {
+		return false
+	}
+	// One pass over the bytes rather than a split, since decoders check every
+	// subject they read. The end of s counts as a separator.
+	start, wild := 0, false
+	for i := 0; i <= len(s); i++ {
+		c := byte(tsep)
+		if i < len(s) {
+			c = s[i]
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			return false
+		case pwc[0], fwc[0]:
+			wild = true
+		case tsep:
+			if i == start {
+				return false
+			}
+			// Wildcards are whole tokens, and ">" only the last one.
+			if wild && (!wildcards || i-start > 1 || (s[start] == fwc[0] && i < len(s))) {
+				return false
+			}
+			start, wild = i+1, false
+		}
+	}
+	return true
+}
+
+// IsLiteral reports whether the pattern p contains no wildcard tokens.
+func IsLiteral(p string) bool {
+	for _, t := range strings.Split(p, sep) {
+		if t == pwc || t == fwc {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the literal subject s matches pattern p.
+func Match(p, s string) bool {
+	pt := strings.Split(p, sep)
+	st := strings.Split(s, sep)
+	for i, t := range pt {
+		if t == fwc {
+			return len(st) > i
+		}
+		if i >= len(st) {
+			return false
+		}
+		if t != pwc && t != st[i] {
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
+
+// Trie stores values under subject patterns and finds all values whose
+// patterns match a given literal subject. The zero value is not usable, use
+// NewTrie. It is safe for concurrent use.
+type Trie struct {
+	root *node
+	mu   sync.RWMutex
+}
+
+type node struct {
+	children map[string]*node
+	values   map[interface{}]struct{}
+}
+
+func newNode() *node {
+	return &node{
+		children: map[string]*node{},
+		values:   map[interface{}]struct{}{},
+	}
+}
+
+func NewTrie() *Trie {
+	return &Trie{root: newNode()}
+}
+
+// Insert stores value under pattern. Inserting the same value under the same
+// pattern twice has no effect. Values must be comparable.
+func (t *Trie) Insert(pattern string, value interface{}) {
+	t.mu.Lock()
+	n := t.root
+	for _, tok := range strings.Split(pattern, sep) {
+		child, ok := n.children[tok]
+		if !ok {
+			child = newNode()
+			n.children[tok] = child
+		}
+		n = child
+	}
+	n.values[value] = struct{}{}
+	t.mu.Unlock()
+}
+
+// Remove deletes value from under pattern and reports whether it was there.
+func (t *Trie) Remove(pattern string, value interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.remove(strings.Split(pattern, sep), value)
+}
+
+func (n *node) remove(tokens []string, value interface{}) bool {
+	if len(tokens) == 0 {
+		if _, ok := n.values[value]; !ok {
+			return false
+		}
+		delete(n.values, value)
+		return true
+	}
+	child, ok := n.children[tokens[0]]
+	if !ok {
+		return false
+	}
+	removed := child.remove(tokens[1:], value)
+	if len(child.values) == 0 && len(child.children) == 0 {
+		delete(n.children, tokens[0])
+	}
+	return removed
+}
+
+// Match returns every value stored under a pattern that matches the literal
+// subject s. A value stored under several matching patterns is returned once.
+func (t *Trie) Match(s string) []interface{} {
+	seen := map[interface{}]struct{}{}
+	var values []interface{}
+	t.mu.RLock()
+	t.root.match(s, func(v interface{}) {
+		if _, ok := seen[v]; ok {
+			return
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	})
+	t.mu.RUnlock()
+	return values
+}
+
+// HasMatch reports whether any pattern in the trie matches s.
+func (t *Trie) HasMatch(s string) bool {
+	found := false
+	t.mu.RLock()
+	t.root.match(s, func(interface{}) { found = true })
+	t.mu.RUnlock()
+	return found
+}
+
+// Len returns the number of pattern-value pairs stored in the trie.
+func (t *Trie) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.len()
+}
+
+func (n *node) len() int {
+	l := len(n.values)
+	for _, child := range n.children {
+		l += child.len()
+	}
+	return l
+}
+
+func (n *node) match(s string, fn func(interface{})) {
+	tok, rest := s, ""
+	last := true
+	if i := strings.IndexByte(s, tsep); i >= 0 {
+		tok, rest = s[:i], s[i+1:]
+		last = false
+	}
+
+	if child, ok := n.children[fwc]; ok {
+		for v := range child.values {
+			fn(v)
+		}
+	}
+	for _, key := range [2]string{tok, pwc} {
+		child, ok := n.children[key]
+		if !ok {
+			continue
+		}
+		if last {
+			for v := range child.values {
+				fn(v)
+			}
+		} else {
+			child.match(rest, fn)
+		}
+	}
+}
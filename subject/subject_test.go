@@ -0,0 +1,82 @@
+package subject
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValid(t *testing.T) {
+	for _, s := range []string{"foo", "foo.bar", "foo.bar-baz.1"} {
+		assert.True(t, ValidSubject(s), s)
+		assert.True(t, ValidPattern(s), s)
+	}
+	for _, s := range []string{"*", "foo.*", "foo.*.bar", ">", "foo.>", "*.>"} {
+		assert.False(t, ValidSubject(s), s)
+		assert.True(t, ValidPattern(s), s)
+	}
+	for _, s := range []string{"", ".", "foo.", ".foo", "foo..bar", "foo.>.bar", "foo*", "fo>o", "foo bar", "*a", ">.foo", "foo\tbar", "foo\r"} {
+		assert.False(t, ValidSubject(s), s)
+		assert.False(t, ValidPattern(s), s)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "foo.bar", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo", false},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+		{"*.*.baz", "foo.bar.baz", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, Match(c.pattern, c.subject), "%s %s", c.pattern, c.subject)
+
+		trie := NewTrie()
+		trie.Insert(c.pattern, 1)
+		assert.Equal(t, c.match, trie.HasMatch(c.subject), "%s %s", c.pattern, c.subject)
+	}
+}
+
+func TestTrie(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert("foo.bar", "a")
+	trie.Insert("foo.*", "b")
+	trie.Insert("foo.>", "c")
+	trie.Insert("foo.*", "a")
+	trie.Insert("foo.*", "b")
+
+	match := func(s string) []string {
+		var ret []string
+		for _, v := range trie.Match(s) {
+			ret = append(ret, v.(string))
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	assert.Equal(t, 4, trie.Len())
+	assert.Equal(t, []string{"a", "b", "c"}, match("foo.bar"))
+	assert.Equal(t, []string{"a", "b", "c"}, match("foo.baz"))
+	assert.Equal(t, []string{"c"}, match("foo.bar.baz"))
+	assert.Nil(t, match("bar"))
+
+	assert.True(t, trie.Remove("foo.*", "a"))
+	assert.False(t, trie.Remove("foo.*", "a"))
+	assert.Equal(t, []string{"b", "c"}, match("foo.baz"))
+
+	trie.Remove("foo.bar", "a")
+	trie.Remove("foo.*", "b")
+	trie.Remove("foo.>", "c")
+	assert.Equal(t, 0, trie.Len())
+	assert.Empty(t, trie.root.children)
+}
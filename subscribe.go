@@ -0,0 +1,90 @@
+package psycho
+
+import "sync"
+
+// Subscription is a subscription made with Subscribe or ChanSubscribe,
+// whose messages are handled by the client's goroutines.
+type Subscription struct {
+	conn *Conn
+	done sync.WaitGroup
+}
+
+// Workers sets how many goroutines Subscribe runs the handler on. With more
+// than one, messages may be handled out of order. The default is 1.
+func Workers(n int) ConnOption {
+	return func(c *Conn) { c.workers = n }
+}
+
+// Subscribe subscribes to subject like Dial, and calls handler with each
+// message received, from as many goroutines as set with Workers.
+func (c *Client) Subscribe(subj string, handler func(*Msg), opts ...ConnOption) (*Subscription, error) {
+	conn, err := c.Dial(subj, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{conn: conn}
+	workers := conn.workers
+	if workers < 1 {
+		workers = 1
+	}
+	s.done.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer s.done.Done()
+			for {
+				msg, err := conn.ReceiveMsg()
+				if err != nil {
+					return
+				}
+				handler(msg)
+			}
+		}()
+	}
+	return s, nil
+}
+
+// ChanSubscribe subscribes to subject like Dial, and sends each message
+// received to ch. Once ch is full, messages wait in the Conn's buffer, where
+// its SlowConsumerPolicy applies. Ch isn't closed on Unsubscribe.
+func (c *Client) ChanSubscribe(subj string, ch chan<- *Msg, opts ...ConnOption) (*Subscription, error) {
+	conn, err := c.Dial(subj, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{conn: conn}
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		for {
+			msg, err := conn.ReceiveMsg()
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-conn.closing:
+				return
+			case <-c.closing:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Subject returns the subject the subscription was made on.
+func (s *Subscription) Subject() string {
+	return s.conn.subject
+}
+
+// Stats returns the counters of the subscription's Conn.
+func (s *Subscription) Stats() ConnStats {
+	return s.conn.Stats()
+}
+
+// Unsubscribe stops the subscription and waits for the handler calls in
+// progress to return, so it mustn't be called from the handler itself.
+func (s *Subscription) Unsubscribe() {
+	s.conn.Close()
+	s.done.Wait()
+}
@@ -0,0 +1,83 @@
+package psycho
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recv(t *testing.T, ch <-chan *Msg) *Msg {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	c := NewServerClient(&fakeServer{})
+	defer c.Close()
+
+	msgs := make(chan *Msg, 10)
+	sub, err := c.Subscribe("foo.*", func(msg *Msg) { msgs <- msg })
+	require.NoError(t, err)
+	assert.Equal(t, "foo.*", sub.Subject())
+	// The SUB goes out before the PUB on the same connection.
+	require.NoError(t, c.Publish("foo.bar", []byte("hi")))
+	msg := recv(t, msgs)
+	assert.Equal(t, "foo.bar", msg.Subject)
+	assert.Equal(t, "hi", string(msg.Payload))
+	sub.Unsubscribe()
+	assert.Equal(t, uint64(1), sub.Stats().Msgs)
+}
+
+func TestClientSubscribeWorkers(t *testing.T) {
+	c := NewServerClient(&fakeServer{})
+	defer c.Close()
+
+	// Each call waits for the other two, which only works if they run at
+	// once.
+	const workers = 3
+	var calls int32
+	all := make(chan struct{})
+	sub, err := c.Subscribe("foo", func(*Msg) {
+		if atomic.AddInt32(&calls, 1) == workers {
+			close(all)
+		}
+		<-all
+	}, Workers(workers))
+	require.NoError(t, err)
+	for i := 0; i < workers; i++ {
+		require.NoError(t, c.Publish("foo", nil))
+	}
+	select {
+	case <-all:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%d handler calls at once, want %d", atomic.LoadInt32(&calls), workers)
+	}
+	sub.Unsubscribe()
+}
+
+func TestClientChanSubscribe(t *testing.T) {
+	server := &fakeServer{}
+	c := NewServerClient(server)
+	defer c.Close()
+
+	ch := make(chan *Msg, 1)
+	sub, err := c.ChanSubscribe("foo", ch)
+	require.NoError(t, err)
+	require.NoError(t, c.Publish("foo", []byte("hi")))
+	assert.Equal(t, "hi", string(recv(t, ch).Payload))
+
+	sub.Unsubscribe()
+	assert.Eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.subs) == 0
+	}, 5*time.Second, time.Millisecond)
+}
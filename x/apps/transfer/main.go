@@ -39,42 +39,44 @@ func main() {
 		return
 	}
 
-	// codec := psycho.NewServerCodec(os.Stdin, os.Stdout)
+	client := psycho.NewServerClient(server)
+	info, err := client.Info()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println(info)
 
 	if !*receiverBool {
-		go func() {
-			for i := 0; ; i++ {
-				server.Pub("subject", []byte(strconv.Itoa(i)))
-				time.Sleep(100 * time.Microsecond)
+		for i := 0; ; i++ {
+			if err := client.Publish("subject", []byte(strconv.Itoa(i))); err != nil {
+				log.Println(err)
+				return
 			}
-		}()
-	} else {
-		server.Sub("subject")
+			time.Sleep(100 * time.Microsecond)
+		}
 	}
 
-	// go codec.ServeClientOpsTo(server)
-	server.ServeServerOpsTo(&handler{})
-}
+	// Messages are handled one at a time, in order, so gaps in the sequence
+	// are messages that went missing.
+	last := 0
+	_, err = client.Subscribe("subject", func(msg *psycho.Msg) {
+		i, err := strconv.Atoi(string(msg.Payload))
+		if err != nil {
+			fmt.Println(err)
+		}
 
-type handler struct {
-	i int
-}
+		if i == 0 {
+			fmt.Println("first", i)
+		} else if i-last != 1 {
+			fmt.Println(last, "->", i)
+		}
 
-func (h *handler) HandleInfo(info map[string]interface{}) {
-	fmt.Println(info)
-}
-
-func (h *handler) HandleMsg(subject string, payload []byte) {
-	i, err := strconv.Atoi(string(payload))
+		last = i
+	}, psycho.RecvBuffer(1024))
 	if err != nil {
-		fmt.Println(err)
-	}
-
-	if i == 0 {
-		fmt.Println("first", i)
-	} else if i-h.i != 1 {
-		fmt.Println(h.i, "->", i)
+		log.Println(err)
+		return
 	}
-
-	h.i = i
+	select {}
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/servers"
+	"github.com/Gaboose/psycho/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests drive psycho.Client against a TinyServer over net.Pipe.
+
+func connect(tiny *TinyServer, opts ...psycho.ClientOption) *psycho.Client {
+	server, conn := net.Pipe()
+	go tiny.Serve(server)
+	return psycho.NewClient(conn, conn, opts...)
+}
+
+// receive calls send until conn receives a message. A SUB may reach the
+// server after a PUB from another client, so a single send could go missing.
+func receive(t *testing.T, conn *psycho.Conn, send func() error) *psycho.Msg {
+	msgs := make(chan *psycho.Msg, 1)
+	go func() {
+		msg, err := conn.ReceiveMsg()
+		assert.NoError(t, err)
+		msgs <- msg
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		require.NoError(t, send())
+		select {
+		case msg := <-msgs:
+			return msg
+		case <-time.After(20 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no message received")
+		}
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	c := connect(NewTinyServer(Config{}))
+	defer c.Close()
+
+	info, err := c.Info()
+	require.NoError(t, err)
+	assert.Equal(t, "tiny", info["name"])
+	assert.Equal(t, "1048576", info["max_payload"])
+}
+
+func TestClientPubSub(t *testing.T) {
+	for _, encoding := range protocol.Encodings {
+		t.Run(encoding, func(t *testing.T) {
+			tiny := NewTinyServer(Config{})
+			sub := connect(tiny, psycho.Encoding(encoding))
+			defer sub.Close()
+			pub := connect(tiny, psycho.Encoding(encoding))
+			defer pub.Close()
+
+			conn, err := sub.Dial("foo.*")
+			require.NoError(t, err)
+			header := psycho.Header{}
+			header.Set("Trace", "1")
+			msg := receive(t, conn, func() error {
+				return pub.PublishMsg(&psycho.Msg{Subject: "foo.bar", Reply: "baz", Header: header, Payload: []byte("hello")})
+			})
+			assert.Equal(t, &psycho.Msg{Subject: "foo.bar", Reply: "baz", Header: header, Payload: []byte("hello")}, msg)
+		})
+	}
+}
+
+func TestClientConnSend(t *testing.T) {
+	c := connect(NewTinyServer(Config{}))
+	defer c.Close()
+
+	conn, err := c.Dial("foo")
+	require.NoError(t, err)
+	msg := receive(t, conn, func() error { return conn.Send([]byte("hello")) })
+	assert.Equal(t, "hello", string(msg.Payload))
+
+	wildcard, err := c.Dial("foo.>")
+	require.NoError(t, err)
+	assert.IsType(t, psycho.ErrInvalidSubject{}, wildcard.Send(nil))
+}
+
+func TestClientFlush(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	sub := connect(tiny)
+	defer sub.Close()
+	pub := connect(tiny)
+	defer pub.Close()
+
+	// Once flushed, the SUB is in place, so a single publish arrives.
+	conn, err := sub.Dial("foo")
+	require.NoError(t, err)
+	require.NoError(t, sub.Flush(context.Background()))
+	require.NoError(t, pub.Publish("foo", []byte("hi")))
+	msg, err := conn.ReceiveMsg()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(msg.Payload))
+}
+
+func TestClientRequest(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	responder := connect(tiny)
+	defer responder.Close()
+	requester := connect(tiny)
+	defer requester.Close()
+
+	conn, err := responder.Dial("echo")
+	require.NoError(t, err)
+	replies := make(chan string, 100)
+	go func() {
+		for {
+			msg, err := conn.ReceiveMsg()
+			if err != nil {
+				return
+			}
+			replies <- msg.Reply
+			responder.Publish(msg.Reply, append([]byte("re: "), msg.Payload...))
+		}
+	}()
+
+	// The responder's SUB may reach the server after the first requests.
+	var resp []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for resp == nil && time.Now().Before(deadline) {
+		resp, err = requester.Request("echo", []byte("hi"), 100*time.Millisecond)
+		if err != nil {
+			require.Equal(t, psycho.ErrTimeout{}, err)
+		}
+	}
+	assert.Equal(t, "re: hi", string(resp))
+	assert.True(t, strings.HasPrefix(<-replies, "_INBOX."))
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	c := connect(NewTinyServer(Config{}))
+	defer c.Close()
+
+	start := time.Now()
+	_, err := c.Request("nobody", []byte("hi"), 50*time.Millisecond)
+	assert.Equal(t, psycho.ErrTimeout{}, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestClientClose(t *testing.T) {
+	c := connect(NewTinyServer(Config{}))
+	conn, err := c.Dial("foo")
+	require.NoError(t, err)
+	assert.NoError(t, c.Err())
+
+	assert.NoError(t, c.Close())
+	assert.Equal(t, psycho.ErrConnClosed{}, c.Err())
+	_, err = c.Dial("bar")
+	assert.Equal(t, psycho.ErrConnClosed{}, err)
+	assert.Equal(t, psycho.ErrConnClosed{}, c.Publish("foo", nil))
+	assert.Equal(t, psycho.ErrConnClosed{}, conn.Send(nil))
+	_, err = conn.Receive()
+	assert.Equal(t, psycho.ErrConnClosed{}, err)
+	conn.Close()
+	assert.NoError(t, c.Close())
+}
+
+func TestClientServerGone(t *testing.T) {
+	server, conn := net.Pipe()
+	c := psycho.NewClient(conn, conn)
+	defer c.Close()
+	server.Close()
+
+	assert.Eventually(t, func() bool { return c.Err() == io.EOF }, time.Second, time.Millisecond)
+	_, err := c.Info()
+	assert.Equal(t, io.EOF, err)
+}
+
+// noPongs is a server's end of a connection that stops the server's PONGs
+// from reaching the client.
+type noPongs struct {
+	net.Conn
+	dropped int32
+}
+
+func (c *noPongs) Write(b []byte) (int, error) {
+	if string(b) == "PONG\n" {
+		atomic.AddInt32(&c.dropped, 1)
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestClientStaleConnection(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	opts := []psycho.ClientOption{psycho.PingInterval(20 * time.Millisecond), psycho.MaxPingsOut(2)}
+
+	// A server that answers keeps the client going.
+	c := connect(tiny, opts...)
+	defer c.Close()
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, c.Err())
+
+	server, conn := net.Pipe()
+	silent := &noPongs{Conn: server}
+	go tiny.Serve(silent)
+	c = psycho.NewClient(conn, conn, opts...)
+	defer c.Close()
+	assert.Eventually(t, func() bool { return c.Err() == psycho.ErrStaleConnection{} }, 5*time.Second, time.Millisecond)
+	// The client gave up after MaxPingsOut unanswered pings.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&silent.dropped))
+}
+
+// recorder is a client's end of a connection that records what the client
+// reads.
+type recorder struct {
+	net.Conn
+	read bytes.Buffer
+	mu   sync.Mutex
+}
+
+func (c *recorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recorder) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read.String()
+}
+
+func TestClientVerbose(t *testing.T) {
+	for _, verbose := range []bool{false, true} {
+		server, conn := net.Pipe()
+		go NewTinyServer(Config{}).Serve(server)
+		rec := &recorder{Conn: conn}
+		opts := []psycho.ClientOption{}
+		if verbose {
+			opts = append(opts, psycho.Verbose(true))
+		}
+		c := psycho.NewClient(rec, rec, opts...)
+
+		sub, err := c.Dial("foo")
+		require.NoError(t, err)
+		receive(t, sub, func() error { return sub.Send(nil) })
+		// Acknowledgements are only sent to clients that ask for them.
+		assert.Equal(t, verbose, strings.Contains(rec.String(), "+OK\n"), "verbose %v", verbose)
+		c.Close()
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	servers := make(chan net.Conn, 10)
+	dial := func() (io.ReadWriteCloser, error) {
+		server, conn := net.Pipe()
+		go tiny.Serve(server)
+		servers <- server
+		return conn, nil
+	}
+	reconnected := make(chan struct{}, 1)
+	c, err := psycho.Connect(dial,
+		psycho.ReconnectWait(time.Millisecond, 10*time.Millisecond),
+		psycho.ReconnectHandler(func() { reconnected <- struct{}{} }),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+	pub := connect(tiny)
+	defer pub.Close()
+
+	conn, err := c.Dial("foo")
+	require.NoError(t, err)
+	receive(t, conn, func() error { return pub.Publish("foo", []byte("before")) })
+
+	// The server drops the connection, and the subscription resumes on the
+	// next one.
+	(<-servers).Close()
+	<-reconnected
+	receive(t, conn, func() error { return pub.Publish("foo", []byte("after")) })
+	assert.NoError(t, c.Err())
+}
+
+func TestClientAuthorization(t *testing.T) {
+	tiny := NewTinyServer(Config{Token: "secret"})
+
+	c := connect(tiny, psycho.Token("secret"))
+	defer c.Close()
+	conn, err := c.Dial("foo")
+	require.NoError(t, err)
+	receive(t, conn, func() error { return conn.Send(nil) })
+	assert.NoError(t, c.Err())
+
+	denied := connect(tiny, psycho.Token("guess"))
+	defer denied.Close()
+	assert.Eventually(t, func() bool { return denied.Err() == psycho.ErrAuthorization{} }, time.Second, time.Millisecond)
+}
+
+func TestClientPayloadTooLarge(t *testing.T) {
+	c := connect(NewTinyServer(Config{MaxPayload: 16}))
+	defer c.Close()
+
+	_, err := c.Info()
+	require.NoError(t, err)
+	assert.IsType(t, psycho.ErrPayloadTooLarge{}, c.Publish("foo", make([]byte, 17)))
+	assert.NoError(t, c.Publish("foo", make([]byte, 16)))
+}
+
+func TestConformance(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	servertest.Run(t, func(t *testing.T) psycho.ServerV2 {
+		return servers.NewRemote(connect(tiny, psycho.NoEcho()))
+	})
+}
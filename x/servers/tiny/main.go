@@ -3,104 +3,257 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
-	"sync"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/Gaboose/psycho"
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/Gaboose/psycho/subject"
 )
 
+type Config struct {
+	// PingInterval is how often clients are pinged. Zero disables pings.
+	PingInterval time.Duration
+	// MaxPingsOut is how many pings in a row a client may leave unanswered
+	// before its connection is closed.
+	MaxPingsOut int
+	// Token and Users are the credentials clients must CONNECT with. If both
+	// are empty, no authentication is required.
+	Token string
+	Users map[string]string
+	// MaxPayload is the largest payload, headers included, clients may
+	// publish. Zero means protocol.DefaultMaxPayload.
+	MaxPayload int
+}
+
+func (c Config) authRequired() bool {
+	return c.Token != "" || len(c.Users) > 0
+}
+
 type TinyServer struct {
+	cfg  Config
 	info map[string]interface{}
-	subs map[string]map[chan<- *psycho.ClientOperation]struct{}
-	mu   sync.Mutex
+	subs *subject.Trie
 }
 
-func NewTinyServer() *TinyServer {
+func NewTinyServer(cfg Config) *TinyServer {
+	if cfg.MaxPayload == 0 {
+		cfg.MaxPayload = protocol.DefaultMaxPayload
+	}
 	return &TinyServer{
+		cfg: cfg,
 		info: map[string]interface{}{
-			"name":    "tiny",
-			"version": "0.1",
+			"name":          "tiny",
+			"version":       "0.1",
+			"auth_required": cfg.authRequired(),
+			"max_payload":   cfg.MaxPayload,
+			"encodings":     protocol.Encodings,
 		},
-		subs: map[string]map[chan<- *psycho.ClientOperation]struct{}{},
+		subs: subject.NewTrie(),
 	}
 }
 
+// subscription is a single SUB of a connection. Messages matching it are
+// passed to the connection's msgs channel along with the subscription's sid.
+// Of all subscriptions in the same queue group, that is with the same subject
+// and queue, across all connections, only one gets each message. Messages
+// that don't fit in msgs are counted in dropped, which is shared by all
+// subscriptions of the connection.
+type subscription struct {
+	subject string
+	queue   string
+	sid     uint64
+	msgs    chan<- delivery
+	dropped *uint64
+}
+
+type subKey struct {
+	subject string
+	queue   string
+	sid     uint64
+}
+
+// msgBuffer is how many messages a connection holds for its client before
+// dropping more.
+const msgBuffer = 256
+
+type delivery struct {
+	op  *protocol.ClientOperation
+	sid uint64
+}
+
 func (r *TinyServer) Serve(conn net.Conn) {
 	defer conn.Close()
-	clientOpCh := make(chan *psycho.ClientOperation, 10)
-	go reader(psycho.NewServerDecoder(conn), clientOpCh)
+	clientOpCh := make(chan read, 10)
+	decoder := protocol.NewServerDecoder(conn)
+	decoder.SetMaxPayload(r.cfg.MaxPayload)
+	go reader(decoder, clientOpCh)
 
-	encoder := psycho.NewServerEncoder(conn)
+	encoder := protocol.NewServerEncoder(conn)
 	encoder.Info(r.info)
 
-	recvMsgCh := make(chan *psycho.ClientOperation, 10)
+	recvMsgCh := make(chan delivery, msgBuffer)
+	var dropped uint64
+
+	var pingCh <-chan time.Time
+	if r.cfg.PingInterval > 0 {
+		ticker := time.NewTicker(r.cfg.PingInterval)
+		defer ticker.Stop()
+		pingCh = ticker.C
+	}
+	var pingsOut int
+	authorized := !r.cfg.authRequired()
+	// Clients that don't say otherwise in CONNECT get every op acknowledged,
+	// and their own messages.
+	verbose := true
+	var noEcho bool
+	ack := func() {
+		if verbose {
+			encoder.OK()
+		}
+	}
 
-	subscribedSubjects := map[string]struct{}{}
+	subscriptions := map[subKey]*subscription{}
 	defer func() {
-		r.mu.Lock()
-		for sub := range subscribedSubjects {
-			delete(r.subs[sub], recvMsgCh)
+		for _, sub := range subscriptions {
+			r.subs.Remove(sub.subject, sub)
 		}
-		r.mu.Unlock()
 	}()
 
 	for {
 		select {
-		case op, ok := <-clientOpCh:
-			if !ok {
+		case rd := <-clientOpCh:
+			op := rd.op
+			if rd.err == io.EOF {
 				return
 			}
-			if op.Error != nil {
-				log.Printf("closing connection %v: %v", conn.RemoteAddr(), op.Error)
-				encoder.Err(op.Error.Error())
+			if rd.err != nil {
+				encoder.Err(rd.err)
+				if !protocol.IsFatal(rd.err) {
+					continue
+				}
+				log.Printf("closing connection %v: %v", conn.RemoteAddr(), rd.err)
+				return
+			}
+
+			if op.Type == protocol.TypeConnect {
+				authorized = op.Connect.Authorized(r.cfg.Token, r.cfg.Users)
+			}
+			if !authorized {
+				log.Printf("closing connection %v: authorization violation", conn.RemoteAddr())
+				encoder.Err(protocol.ErrAuthorization{})
 				return
 			}
 
 			switch op.Type {
-			case psycho.TypePublish:
-				r.mu.Lock()
-				chans := r.subs[op.Subject]
-				r.mu.Unlock()
-				for ch := range chans {
-					select {
-					case ch <- op:
-					default:
-						log.Printf("channel full on subject %v\n", op.Subject)
+			case protocol.TypeConnect:
+				if err := encoder.SetEncoding(op.Connect.Encoding); err != nil {
+					encoder.Err(err)
+					return
+				}
+				verbose = op.Connect.Verbose
+				noEcho = op.Connect.NoEcho
+				ack()
+			case protocol.TypePing:
+				encoder.Pong()
+			case protocol.TypePong:
+				pingsOut = 0
+			case protocol.TypePublish:
+				var except chan<- delivery
+				if noEcho {
+					except = recvMsgCh
+				}
+				r.publish(op, except)
+				ack()
+			case protocol.TypeSubscribe:
+				key := subKey{op.Subject, op.Queue, op.SID}
+				if _, ok := subscriptions[key]; !ok {
+					sub := &subscription{
+						subject: op.Subject,
+						queue:   op.Queue,
+						sid:     op.SID,
+						msgs:    recvMsgCh,
+						dropped: &dropped,
 					}
+					subscriptions[key] = sub
+					r.subs.Insert(op.Subject, sub)
 				}
-				encoder.OK()
-			case psycho.TypeSubscribe:
-				subscribedSubjects[op.Subject] = struct{}{}
-				r.mu.Lock()
-				m, ok := r.subs[op.Subject]
-				if !ok {
-					m = map[chan<- *psycho.ClientOperation]struct{}{}
-					r.subs[op.Subject] = m
+				ack()
+			case protocol.TypeUnsubscribe:
+				key := subKey{op.Subject, op.Queue, op.SID}
+				if sub, ok := subscriptions[key]; ok {
+					delete(subscriptions, key)
+					r.subs.Remove(op.Subject, sub)
 				}
-				m[recvMsgCh] = struct{}{}
-				r.mu.Unlock()
-				encoder.OK()
-			case psycho.TypeUnsubscribe:
-				delete(subscribedSubjects, op.Subject)
-				r.mu.Lock()
-				delete(r.subs[op.Subject], recvMsgCh)
-				r.mu.Unlock()
-				encoder.OK()
+				ack()
+			}
+		case d := <-recvMsgCh:
+			encoder.Msg(d.op.Subject, d.sid, d.op.Reply, d.op.Header, d.op.Payload)
+			// Once the backlog drains, tell the client what it missed.
+			if n := atomic.SwapUint64(&dropped, 0); n > 0 {
+				encoder.Err(protocol.ErrSlowConsumer{Reason: fmt.Sprintf("%d messages dropped", n)})
 			}
-		case op := <-recvMsgCh:
-			encoder.Msg(op.Subject, op.Payload)
+		case <-pingCh:
+			if pingsOut >= r.cfg.MaxPingsOut {
+				log.Printf("closing connection %v: stale connection", conn.RemoteAddr())
+				return
+			}
+			pingsOut++
+			encoder.Ping()
 		}
 	}
 
 }
 
-func reader(dec *psycho.ServerDecoder, ch chan<- *psycho.ClientOperation) {
+// publish delivers op to the matching subscriptions, except to those whose
+// msgs is except, which belong to a client that asked for no echo.
+func (r *TinyServer) publish(op *protocol.ClientOperation, except chan<- delivery) {
+	var subs []*subscription
+	groups := map[subKey][]*subscription{}
+	for _, v := range r.subs.Match(op.Subject) {
+		sub := v.(*subscription)
+		if sub.msgs == except {
+			continue
+		}
+		if sub.queue != "" {
+			group := subKey{subject: sub.subject, queue: sub.queue}
+			groups[group] = append(groups[group], sub)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	for _, members := range groups {
+		subs = append(subs, members[rand.Intn(len(members))])
+	}
+
+	for _, sub := range subs {
+		select {
+		case sub.msgs <- delivery{op, sub.sid}:
+		default:
+			log.Printf("channel full on subject %v\n", op.Subject)
+			atomic.AddUint64(sub.dropped, 1)
+		}
+	}
+}
+
+// read is an op read from a connection, or the error that reading it failed
+// with.
+type read struct {
+	op  *protocol.ClientOperation
+	err error
+}
+
+// reader passes the ops read by dec to ch until an error that leaves dec
+// unusable, which is passed on last.
+func reader(dec *protocol.ServerDecoder, ch chan<- read) {
 	for {
-		op, ok := dec.ReadOperation()
-		ch <- &op
-		if !ok {
-			close(ch)
+		op, err := dec.ReadOperation()
+		ch <- read{&op, err}
+		if err != nil && protocol.IsFatal(err) {
 			return
 		}
 	}
@@ -108,6 +261,11 @@ func reader(dec *psycho.ServerDecoder, ch chan<- *psycho.ClientOperation) {
 
 func main() {
 	addr := flag.String("address", "localhost:5023", "address to listen on")
+	pingInterval := flag.Duration("ping-interval", 2*time.Minute, "how often to ping clients, 0 to disable")
+	maxPingsOut := flag.Int("max-pings-out", 2, "unanswered pings before closing a connection")
+	token := flag.String("token", "", "token clients must authenticate with")
+	users := flag.String("users", "", "comma separated user:password pairs clients must authenticate with")
+	maxPayload := flag.Int("max-payload", protocol.DefaultMaxPayload, "largest payload in bytes clients may publish")
 	flag.Parse()
 
 	listener, err := net.Listen("tcp", *addr)
@@ -117,7 +275,20 @@ func main() {
 	}
 	fmt.Printf("listening on %v\n", *addr)
 
-	tiny := NewTinyServer()
+	cfg := Config{
+		PingInterval: *pingInterval,
+		MaxPingsOut:  *maxPingsOut,
+		Token:        *token,
+		Users:        map[string]string{},
+		MaxPayload:   *maxPayload,
+	}
+	for _, pair := range strings.Split(*users, ",") {
+		if i := strings.IndexByte(pair, ':'); i > 0 {
+			cfg.Users[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	tiny := NewTinyServer(cfg)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/psycho/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests speak the protocol to a TinyServer directly, for what the
+// client hides, such as exactly how many messages arrive.
+
+type rawConn struct {
+	enc  *protocol.ClientEncoder
+	ops  chan protocol.ServerOperation
+	msgs []protocol.ServerOperation
+	mu   sync.Mutex
+}
+
+// dial connects to tiny and reads its ops in the background, keeping MSGs
+// aside and passing the others to ops.
+func dial(tiny *TinyServer) *rawConn {
+	server, conn := net.Pipe()
+	go tiny.Serve(server)
+	c := &rawConn{
+		enc: protocol.NewClientEncoder(conn),
+		ops: make(chan protocol.ServerOperation, 100),
+	}
+	go func() {
+		dec := protocol.NewClientDecoder(conn)
+		for {
+			op, err := dec.ReadOperation()
+			if err != nil {
+				close(c.ops)
+				return
+			}
+			if op.Type != protocol.TypeMessage {
+				c.ops <- op
+				continue
+			}
+			c.mu.Lock()
+			c.msgs = append(c.msgs, op)
+			c.mu.Unlock()
+		}
+	}()
+	return c
+}
+
+// expect reads the next op other than a MSG and checks its type.
+func (c *rawConn) expect(t *testing.T, typ protocol.ServerOpType) protocol.ServerOperation {
+	for {
+		select {
+		case op := <-c.ops:
+			if op.Type == protocol.TypeInfo {
+				continue
+			}
+			require.Equal(t, typ, op.Type)
+			return op
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v received", typ)
+		}
+	}
+}
+
+func (c *rawConn) sub(t *testing.T, subj string, sid uint64, queue string) {
+	require.NoError(t, c.enc.Subscribe(subj, sid, queue))
+	c.expect(t, protocol.TypeOK)
+}
+
+// payloads returns the payloads of the MSGs received so far.
+func (c *rawConn) payloads() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var payloads []string
+	for _, msg := range c.msgs {
+		payloads = append(payloads, string(msg.Payload))
+	}
+	return payloads
+}
+
+func TestQueueGroup(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	var members []*rawConn
+	for i := 0; i < 3; i++ {
+		member := dial(tiny)
+		member.sub(t, "foo", 1, "workers")
+		members = append(members, member)
+	}
+	// Neither of these is a member of the group on foo.
+	plain := dial(tiny)
+	plain.sub(t, "foo", 1, "")
+	other := dial(tiny)
+	other.sub(t, ">", 1, "workers")
+
+	pub := dial(tiny)
+	const n = 30
+	for i := 0; i < n; i++ {
+		require.NoError(t, pub.enc.Publish("foo", "", nil, []byte(strconv.Itoa(i))))
+		pub.expect(t, protocol.TypeOK)
+	}
+
+	received := func() []string {
+		var all []string
+		for _, member := range members {
+			all = append(all, member.payloads()...)
+		}
+		return all
+	}
+	assert.Eventually(t, func() bool {
+		return len(received()) >= n && len(plain.payloads()) == n && len(other.payloads()) == n
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Each message went to exactly one member, and every member got some.
+	seen := map[string]bool{}
+	for _, payload := range received() {
+		assert.False(t, seen[payload], "message %s delivered twice", payload)
+		seen[payload] = true
+	}
+	assert.Len(t, seen, n)
+	for _, member := range members {
+		assert.NotEmpty(t, member.payloads())
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	tiny := NewTinyServer(Config{})
+	server, conn := net.Pipe()
+	go tiny.Serve(server)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	go io.WriteString(conn, "CONNECT {\"verbose\":false}\nSUB foo 1\nPING\n")
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "PONG\n" {
+			break
+		}
+	}
+
+	header := protocol.Header{}
+	header.Add("Trace", "1")
+	header.Add("Trace", "2")
+	header.Set("Content-Type", "text/plain")
+	pub := dial(tiny)
+	require.NoError(t, pub.enc.Publish("foo", "", header, []byte("hi")))
+	pub.expect(t, protocol.TypeOK)
+
+	// Headers come through in NATS framing.
+	want := "HMSG foo 1 58 60\n" +
+		"NATS/1.0\r\nContent-Type: text/plain\r\nTrace: 1\r\nTrace: 2\r\n\r\nhi\n"
+	got := make([]byte, len(want))
+	_, err := io.ReadFull(r, got)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+
+	dec := protocol.NewClientDecoder(strings.NewReader(want))
+	op, err := dec.ReadOperation()
+	require.NoError(t, err)
+	assert.Equal(t, header, op.Header)
+	assert.Equal(t, "hi", string(op.Payload))
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	c := dial(NewTinyServer(Config{MaxPayload: 16}))
+	// The server hangs up without reading the payload, which fails the write.
+	go c.enc.Publish("foo", "", nil, make([]byte, 1<<20))
+
+	op := c.expect(t, protocol.TypeError)
+	assert.Equal(t, protocol.CodePayloadTooLarge, op.Code)
+	select {
+	case op, ok := <-c.ops:
+		assert.False(t, ok, "connection still open, got %v", op.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open")
+	}
+}